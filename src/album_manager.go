@@ -1,10 +1,12 @@
 package main
 
 import (
-	"os"
-	"path"
+	"errors"
+	"log/slog"
 )
 
+var errAlbumNotFound = errors.New("Album not found")
+
 type AlbumManager struct {
 	AppState     *AppState
 	Repository   *Repository
@@ -26,15 +28,7 @@ func (m *AlbumManager) createAlbum(albumName string, albumDescription string) (s
 		return "", err
 	}
 
-	albumPath := path.Join(m.AppState.imageDirectoryPath, albumID)
-
-	err = os.MkdirAll(albumPath, 0755)
-	if err != nil {
-		_ = m.Repository.deleteAlbum(albumID)
-		return "", err
-	}
-
-	return albumID, err
+	return albumID, nil
 }
 
 func (m *AlbumManager) getAlbum(albumID string) (*AlbumRecord, error) {
@@ -55,52 +49,61 @@ func (m *AlbumManager) getAllAlbums() ([]*AlbumRecord, error) {
 	return albums, nil
 }
 
-func (m *AlbumManager) deleteAlbum(albumID string) error {
-	albumImages, err := m.Repository.getAllImageRecordsByAlbumID(albumID)
+// getAlbumsForUser returns the albums the user has access to.
+func (m *AlbumManager) getAlbumsForUser(user *UserRecord) ([]*AlbumRecord, error) {
+	albums, err := m.getAllAlbums()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(albumImages) > 0 {
-		err = m.Repository.deleteImagesByAlbumID(albumID)
-		if err != nil {
-			return err
+	visibleAlbums := make([]*AlbumRecord, 0, len(albums))
+	for _, album := range albums {
+		if user.canViewAlbum(album.ID) {
+			visibleAlbums = append(visibleAlbums, album)
 		}
 	}
 
-	err = m.Repository.deleteAlbum(albumID)
+	return visibleAlbums, nil
+}
+
+// createAlbumForUser creates an album on behalf of user. A user limited to
+// their granted albums is granted their account role on the new one, so
+// they can go on to use it.
+func (m *AlbumManager) createAlbumForUser(user *UserRecord, title string, description string) (string, error) {
+	albumID, err := m.createAlbum(title, description)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = os.RemoveAll(m.getAlbumPath(albumID))
-	if err != nil {
-		return err
+	if user.isAlbumScoped() {
+		err = m.Repository.setAlbumPermission(user.ID, albumID, user.Role)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return nil
+	return albumID, nil
 }
 
-func (m *AlbumManager) setAlbumCoverPhoto(albumID string, imageID string) error {
-	err := m.Repository.setCoverPhotoID(albumID, imageID)
+// deleteAlbum removes the album's records in one transaction, then its files.
+// A failure removing files leaves them unused rather than the album half
+// deleted, so it's logged instead of returned.
+func (m *AlbumManager) deleteAlbum(albumID string) error {
+	err := m.Repository.deleteAlbum(albumID)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (m *AlbumManager) setAlbumCoverPhotoIfUnset(albumID string, imageID string) error {
-	album, err := m.Repository.getAlbumRecord(albumID)
+	err = deleteStoragePrefix(m.AppState.Storage, m.getAlbumKey(albumID)+"/")
 	if err != nil {
-		return err
+		slog.Warn("Unable to delete album files", "album_id", albumID, "error", err)
 	}
 
-	if album.CoverPhotoID != nil {
-		return nil
-	}
+	return nil
+}
 
-	err = m.setAlbumCoverPhoto(albumID, imageID)
+func (m *AlbumManager) setAlbumCoverPhoto(albumID string, imageID string) error {
+	err := m.Repository.setCoverPhotoID(albumID, imageID)
 	if err != nil {
 		return err
 	}
@@ -117,6 +120,6 @@ func (m *AlbumManager) updateAlbum(albumID string, title string, description *st
 	return nil
 }
 
-func (m *AlbumManager) getAlbumPath(albumID string) string {
-	return path.Join(m.AppState.imageDirectoryPath, albumID)
+func (m *AlbumManager) getAlbumKey(albumID string) string {
+	return albumID
 }
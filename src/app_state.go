@@ -3,51 +3,91 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/segmentio/ksuid"
 )
 
-const (
-	imageDirectory    = "./data/images/"
-	databaseDirectory = "./data/"
-	databaseName      = "picfolio.db"
-)
-
 type AppState struct {
-	exitCallback       chan bool
+	exitCallback       chan error
+	Config             *Config
+	Lifecycle          *Lifecycle
+	Metrics            *Metrics
 	imageDirectoryPath string
 	databaseFilePath   string
+	RenditionOptions   *RenditionOptions
+	Storage            Storage
 	Repository         *Repository
 	AlbumManager       *AlbumManager
 	ImageManager       *ImageManager
+	JobQueue           *JobQueue
+	UploadEvents       *UploadEvents
+	UserManager        *UserManager
+	TokenManager       *TokenManager
+	SessionManager     *SessionManager
+	TwoFactorManager   *TwoFactorManager
+	OIDCManager        *OIDCManager
+	IntegrityManager   *IntegrityManager
+	TusManager         *TusManager
+	Janitor            *Janitor
 }
 
-func newAppState() *AppState {
-	imageDirectoryPath, _ := filepath.Abs(imageDirectory)
-	databaseDirectoryPath, _ := filepath.Abs(databaseDirectory)
-	databaseFilePath := filepath.Join(databaseDirectoryPath, databaseName)
+func newAppState(config *Config) *AppState {
+	imageDirectoryPath, _ := filepath.Abs(config.Paths.ImageDirectory)
+	databaseDirectoryPath, _ := filepath.Abs(config.Paths.DatabaseDirectory)
+	databaseFilePath := filepath.Join(databaseDirectoryPath, config.Paths.DatabaseName)
 	tempImageDirectoryPath := filepath.Join(imageDirectoryPath, "temp")
 
 	os.MkdirAll(imageDirectoryPath, 0755)
 	os.MkdirAll(databaseDirectoryPath, 0755)
 	os.MkdirAll(tempImageDirectoryPath, 0755)
 
+	storage, err := newStorage(&config.Storage, imageDirectoryPath)
+	if err != nil {
+		fatal("Unable to set up storage", err)
+	}
+
+	renditionSizes := append([]int{}, config.Images.RenditionSizes...)
+	sort.Ints(renditionSizes)
+
 	state := &AppState{
-		exitCallback:       make(chan bool),
+		exitCallback:       make(chan error, 2),
+		Config:             config,
+		Lifecycle:          newLifecycle(),
 		imageDirectoryPath: imageDirectoryPath,
 		databaseFilePath:   databaseFilePath,
-		Repository:         newRepository(),
+		RenditionOptions: &RenditionOptions{
+			Sizes:         renditionSizes,
+			WebP:          config.Images.WebP,
+			ThumbnailSize: config.Images.ThumbnailSize,
+			JPEGQuality:   config.Images.JPEGQuality,
+		},
+		Storage:    storage,
+		Repository: newRepository(),
 	}
+	state.Metrics = newMetrics(state.Repository)
+	state.UploadEvents = newUploadEvents()
 	state.AlbumManager = newAlbumManager(state)
 	state.ImageManager = newImageManager(state)
+	state.JobQueue = newJobQueue(state)
+	state.UserManager = newUserManager(state)
+	state.TokenManager = newTokenManager(state)
+	state.SessionManager = newSessionManager(state)
+	state.TwoFactorManager = newTwoFactorManager(state)
+	state.OIDCManager = newOIDCManager(state, newOIDCOptions(&config.OIDC))
+	state.IntegrityManager = newIntegrityManager(state)
+	state.TusManager = newTusManager(state)
+	state.Janitor = newJanitor(state)
 	return state
 }
 
-func (a AppState) initRepository() {
-	a.Repository.initRepository(a.databaseFilePath)
+func (a *AppState) initRepository() {
+	// Job workers write alongside requests, so writers wait for the lock
+	// rather than failing straight away.
+	a.Repository.initRepository(a.databaseFilePath + "?_busy_timeout=5000")
 }
 
-func (a AppState) generateID() string {
+func (a *AppState) generateID() string {
 	id := ksuid.New()
 	return id.String()
 }
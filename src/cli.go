@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandUsage = `Usage: picfolio <user|token|session|audit> <command> [arguments]
+       picfolio verify [--fix]
+
+User commands:
+  create <username> <role> [--password <password>]
+  list
+  disable <username>
+  enable <username>
+  reset-password <username> [--password <password>]
+  set-role <username> <role>
+  reset-2fa <username>
+  grant <username> <albumID> <role>
+  revoke <username> <albumID>
+
+  A user with album grants only has access to the albums granted, at the
+  role granted in each. Owners have access to every album.
+
+Token commands:
+  create <username> <name> [--expires-days <days>]
+  list <username>
+  revoke <username> <tokenID>
+
+Session commands:
+  rotate-keys
+  logout <username>
+
+Audit commands:
+  logins [--all] [--limit <count>]
+
+verify checks that every image has its files, every file has an image,
+album covers exist and no abandoned uploads are left in temp. --fix
+regenerates missing thumbnails, re-attaches or deletes orphan files and
+resets broken covers.
+
+Roles: owner, editor, uploader, viewer
+When --password is omitted the password is read from standard input.
+`
+
+var errUsage = errors.New("Invalid arguments")
+
+// runCommand handles command line subcommands. It returns false when the
+// arguments don't name a command so the servers start as usual.
+func runCommand(a *AppState, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "user":
+		err = runUserCommand(a.UserManager, a.TwoFactorManager, args[1:], os.Stdin, os.Stdout)
+	case "token":
+		err = runTokenCommand(a.UserManager, a.TokenManager, args[1:], os.Stdout)
+	case "session":
+		err = runSessionCommand(a.UserManager, a.SessionManager, args[1:], os.Stdout)
+	case "audit":
+		err = runAuditCommand(a.Repository, args[1:], os.Stdout)
+	case "verify":
+		err = runVerifyCommand(a.IntegrityManager, args[1:], os.Stdout)
+	default:
+		return false
+	}
+
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, commandUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return true
+}
+
+func runUserCommand(m *UserManager, twoFactor *TwoFactorManager, args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	password := flags.String("password", "", "")
+
+	positional, err := parseCommandArgs(flags, args[1:])
+	if err != nil {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(positional) != 2 {
+			return errUsage
+		}
+		role, err := parseRole(positional[1])
+		if err != nil {
+			return err
+		}
+		if *password == "" {
+			*password, err = readPassword(stdin, stdout)
+			if err != nil {
+				return err
+			}
+		}
+		userID, err := m.createUser(positional[0], *password, role)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Created %s %s (%s)\n", role, positional[0], userID)
+	case "list":
+		users, err := m.getAllUsers()
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "USERNAME\tROLE\tSTATUS\t2FA\tALBUMS")
+		for _, user := range users {
+			status := "active"
+			if user.Disabled {
+				status = "disabled"
+			}
+			hasTwoFactor := "off"
+			if user.HasTwoFactor() {
+				hasTwoFactor = "on"
+			}
+			grants := []string{}
+			for albumID, role := range user.AlbumPermissions {
+				grants = append(grants, albumID+":"+string(role))
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", user.Username, user.Role, status, hasTwoFactor, strings.Join(grants, ","))
+		}
+		return writer.Flush()
+	case "disable", "enable":
+		if len(positional) != 1 {
+			return errUsage
+		}
+		err := m.setUserDisabled(positional[0], args[0] == "disable")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s is now %sd\n", positional[0], args[0])
+	case "reset-password":
+		if len(positional) != 1 {
+			return errUsage
+		}
+		if *password == "" {
+			*password, err = readPassword(stdin, stdout)
+			if err != nil {
+				return err
+			}
+		}
+		err := m.resetPassword(positional[0], *password)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Password updated for %s\n", positional[0])
+	case "set-role":
+		if len(positional) != 2 {
+			return errUsage
+		}
+		role, err := parseRole(positional[1])
+		if err != nil {
+			return err
+		}
+		err = m.setUserRole(positional[0], role)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s is now %s\n", positional[0], role)
+	case "reset-2fa":
+		if len(positional) != 1 {
+			return errUsage
+		}
+		user, err := m.getUserByUsername(positional[0])
+		if err != nil {
+			return err
+		}
+		err = twoFactor.reset(user)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Two-factor authentication removed for %s\n", user.Username)
+	case "grant":
+		if len(positional) != 3 {
+			return errUsage
+		}
+		role, err := parseRole(positional[2])
+		if err != nil {
+			return err
+		}
+		err = m.grantAlbumRole(positional[0], positional[1], role)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s is now %s of album %s\n", positional[0], role, positional[1])
+	case "revoke":
+		if len(positional) != 2 {
+			return errUsage
+		}
+		err := m.revokeAlbumRole(positional[0], positional[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Revoked %s's access to album %s\n", positional[0], positional[1])
+	default:
+		return errUsage
+	}
+
+	return nil
+}
+
+func runTokenCommand(users *UserManager, tokens *TokenManager, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	expiresDays := flags.Int("expires-days", 0, "")
+
+	positional, err := parseCommandArgs(flags, args[1:])
+	if err != nil || len(positional) == 0 {
+		return errUsage
+	}
+
+	user, err := users.getUserByUsername(positional[0])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if len(positional) != 2 || *expiresDays < 0 {
+			return errUsage
+		}
+		var expires *time.Time
+		if *expiresDays > 0 {
+			expiry := time.Now().UTC().AddDate(0, 0, *expiresDays)
+			expires = &expiry
+		}
+		token, record, err := tokens.createToken(user.ID, positional[1], expires)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Created token %s (%s) for %s. It won't be shown again:\n%s\n", record.Name, record.ID, user.Username, token)
+	case "list":
+		if len(positional) != 1 {
+			return errUsage
+		}
+		records, err := tokens.getUserTokens(user.ID)
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tNAME\tCREATED\tEXPIRES\tLAST USED")
+		for _, record := range records {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", record.ID, record.Name, formatCommandTime(&record.Created), formatCommandTime(record.Expires), formatCommandTime(record.LastUsed))
+		}
+		return writer.Flush()
+	case "revoke":
+		if len(positional) != 2 {
+			return errUsage
+		}
+		err := tokens.revokeToken(user.ID, positional[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Revoked token %s\n", positional[1])
+	default:
+		return errUsage
+	}
+
+	return nil
+}
+
+func runSessionCommand(users *UserManager, sessions *SessionManager, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "rotate-keys":
+		if len(args) != 1 {
+			return errUsage
+		}
+		if sessions.hasConfiguredKeys() {
+			return errors.New("Session keys are configured, rotate them by adding a new pair to the front of sessions.keys or SESSION_KEYS")
+		}
+		_, err := sessions.rotateKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Created a new session key pair and kept the last %d. Restart the server to start using it.\n", sessionKeyRetention)
+	case "logout":
+		if len(args) != 2 {
+			return errUsage
+		}
+		user, err := users.getUserByUsername(args[1])
+		if err != nil {
+			return err
+		}
+		err = sessions.revokeUserSessions(user.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Signed out all server-side sessions of %s\n", user.Username)
+	default:
+		return errUsage
+	}
+
+	return nil
+}
+
+func runAuditCommand(repository *Repository, args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "logins" {
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet("audit logins", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	all := flags.Bool("all", false, "")
+	limit := flags.Int("limit", 50, "")
+
+	positional, err := parseCommandArgs(flags, args[1:])
+	if err != nil || len(positional) != 0 || *limit <= 0 {
+		return errUsage
+	}
+
+	records, err := repository.getLoginAttemptRecords(!*all, *limit)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tUSERNAME\tIP ADDRESS\tRESULT\tUSER AGENT")
+	for _, record := range records {
+		result := "success"
+		if record.Reason != nil {
+			result = *record.Reason
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", formatCommandTime(&record.Created), record.Username, record.IPAddress, result, record.UserAgent)
+	}
+	return writer.Flush()
+}
+
+func runVerifyCommand(m *IntegrityManager, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	fix := flags.Bool("fix", false, "")
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil || len(positional) != 0 {
+		return errUsage
+	}
+
+	report, err := m.verify()
+	if err != nil {
+		return err
+	}
+
+	if *fix {
+		m.fix(report)
+	}
+
+	unresolved := 0
+	if len(report.Issues) > 0 {
+		writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "PROBLEM\tFILE\tACTION\tRESULT\tDETAIL")
+		for _, issue := range report.Issues {
+			result := "-"
+			if issue.Fixed {
+				result = "fixed"
+			} else if issue.Error != "" {
+				result = "failed: " + issue.Error
+			}
+			if !issue.Fixed {
+				unresolved++
+			}
+
+			key := issue.Key
+			if key == "" {
+				key = issue.AlbumID
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", issue.Kind, key, issue.Action, result, issue.Detail)
+		}
+		writer.Flush()
+		fmt.Fprintln(stdout)
+	}
+
+	fmt.Fprintf(stdout, "Checked %d albums, %d images and %d files, found %d problems\n", report.Albums, report.Images, report.Files, len(report.Issues))
+
+	if unresolved == 0 {
+		return nil
+	}
+	if !*fix {
+		return fmt.Errorf("Run picfolio verify --fix to repair %d problems", unresolved)
+	}
+	return fmt.Errorf("%d problems couldn't be fixed", unresolved)
+}
+
+func formatCommandTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// parseCommandArgs allows flags to appear before or after positional arguments.
+func parseCommandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func readPassword(stdin io.Reader, stdout io.Writer) (string, error) {
+	fmt.Fprint(stdout, "Password: ")
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("Couldn't read password")
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is everything an instance can be set up with. Values come from the
+// defaults below, then the YAML file named by --config or PICFOLIO_CONFIG,
+// then environment variables, then command line flags, each overriding the
+// one before.
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Paths    PathsConfig    `yaml:"paths"`
+	Images   ImagesConfig   `yaml:"images"`
+	Storage  StorageConfig  `yaml:"storage"`
+	Sessions SessionsConfig `yaml:"sessions"`
+	OIDC     OIDCConfig     `yaml:"oidc"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Janitor  JanitorConfig  `yaml:"janitor"`
+	Uploads  UploadsConfig  `yaml:"uploads"`
+	Jobs     JobsConfig     `yaml:"jobs"`
+}
+
+type ServerConfig struct {
+	PublicAddress     string        `yaml:"public_address" env:"PUBLIC_ADDRESS" flag:"public-address"`
+	AdminAddress      string        `yaml:"admin_address" env:"ADMIN_ADDRESS" flag:"admin-address"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+	// ShutdownTimeout is how long uploads and image processing get to finish
+	// after SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies"`
+}
+
+type PathsConfig struct {
+	ImageDirectory    string `yaml:"image_directory" env:"IMAGE_DIRECTORY" flag:"image-directory"`
+	DatabaseDirectory string `yaml:"database_directory" env:"DATABASE_DIRECTORY" flag:"database-directory"`
+	DatabaseName      string `yaml:"database_name" env:"DATABASE_NAME" flag:"database-name"`
+}
+
+type ImagesConfig struct {
+	ThumbnailSize  int   `yaml:"thumbnail_size" env:"THUMBNAIL_SIZE" flag:"thumbnail-size"`
+	JPEGQuality    int   `yaml:"jpeg_quality" env:"JPEG_QUALITY" flag:"jpeg-quality"`
+	RenditionSizes []int `yaml:"rendition_sizes" env:"RENDITION_SIZES" flag:"rendition-sizes"`
+	WebP           bool  `yaml:"webp" env:"WEBP_RENDITIONS" flag:"webp"`
+}
+
+type StorageConfig struct {
+	Backend string   `yaml:"backend" env:"STORAGE_BACKEND" flag:"storage-backend"`
+	S3      S3Config `yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	AccessKeyID     string `yaml:"access_key_id" env:"S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secret_access_key" env:"S3_SECRET_ACCESS_KEY"`
+	Bucket          string `yaml:"bucket" env:"S3_BUCKET"`
+	Region          string `yaml:"region" env:"S3_REGION"`
+	UseSSL          bool   `yaml:"use_ssl" env:"S3_USE_SSL"`
+}
+
+// MetricsConfig moves /healthz, /readyz and /metrics off the admin server
+// onto their own address when Address is set.
+type MetricsConfig struct {
+	Address string `yaml:"address" env:"METRICS_ADDRESS" flag:"metrics-address"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log-format"`
+}
+
+// UploadsConfig limits how large uploads can be. Requests past a limit are
+// refused with 413. Zero means no limit. Resumable uploads that haven't
+// received data for ResumableExpiration are deleted, unless it's zero.
+type UploadsConfig struct {
+	MaxFileSize         ByteSize      `yaml:"max_file_size" env:"UPLOAD_MAX_FILE_SIZE" flag:"upload-max-file-size"`
+	MaxRequestSize      ByteSize      `yaml:"max_request_size" env:"UPLOAD_MAX_REQUEST_SIZE" flag:"upload-max-request-size"`
+	ResumableExpiration time.Duration `yaml:"resumable_expiration" env:"UPLOAD_RESUMABLE_EXPIRATION" flag:"upload-resumable-expiration"`
+}
+
+// ByteSize is a number of bytes, written as a plain number or with a unit
+// such as 200MB or 2GB. Units are powers of 1024.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func parseByteSize(value string) (ByteSize, error) {
+	// MiB and MB mean the same here.
+	normalized := strings.Replace(strings.ToUpper(strings.TrimSpace(value)), "IB", "B", 1)
+
+	multiplier := ByteSize(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(normalized, unit.suffix) {
+			multiplier = unit.size
+			normalized = strings.TrimSpace(strings.TrimSuffix(normalized, unit.suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseInt(normalized, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("expected a size like 500KB, 200MB or 2GB, got %q", value)
+	}
+
+	return ByteSize(number) * multiplier, nil
+}
+
+func (s *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	err := unmarshal(&value)
+	if err != nil {
+		return err
+	}
+
+	*s, err = parseByteSize(value)
+	return err
+}
+
+func (s ByteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if s >= unit.size && s%unit.size == 0 {
+			return fmt.Sprintf("%d%s", s/unit.size, unit.suffix)
+		}
+	}
+
+	return "0"
+}
+
+// JanitorConfig sets how often abandoned temp uploads and files without an
+// image are cleaned up. Nothing younger than GracePeriod is touched, since it
+// may belong to an upload in progress. An Interval of zero only cleans up at
+// startup, and a QuarantineRetention of zero keeps quarantined files forever.
+type JanitorConfig struct {
+	Interval            time.Duration `yaml:"interval" env:"JANITOR_INTERVAL" flag:"janitor-interval"`
+	GracePeriod         time.Duration `yaml:"grace_period" env:"JANITOR_GRACE_PERIOD" flag:"janitor-grace-period"`
+	QuarantineRetention time.Duration `yaml:"quarantine_retention" env:"JANITOR_QUARANTINE_RETENTION" flag:"janitor-quarantine-retention"`
+}
+
+// JobsConfig sizes the worker pool that processes images in the background.
+// A failed job is tried up to MaxAttempts times, waiting RetryDelay before
+// the first retry and twice as long before each one after. Finished jobs are
+// kept for Retention so their status can still be looked up.
+type JobsConfig struct {
+	Workers     int           `yaml:"workers" env:"JOB_WORKERS" flag:"job-workers"`
+	MaxAttempts int           `yaml:"max_attempts" env:"JOB_MAX_ATTEMPTS" flag:"job-max-attempts"`
+	RetryDelay  time.Duration `yaml:"retry_delay" env:"JOB_RETRY_DELAY" flag:"job-retry-delay"`
+	Retention   time.Duration `yaml:"retention" env:"JOB_RETENTION" flag:"job-retention"`
+}
+
+type SessionsConfig struct {
+	Store string `yaml:"store" env:"SESSION_STORE" flag:"session-store"`
+	Keys  string `yaml:"keys" env:"SESSION_KEYS"`
+}
+
+type OIDCConfig struct {
+	Issuer        string            `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID      string            `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret  string            `yaml:"client_secret" env:"OIDC_CLIENT_SECRET"`
+	RedirectURL   string            `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+	Scopes        []string          `yaml:"scopes" env:"OIDC_SCOPES"`
+	UsernameClaim string            `yaml:"username_claim" env:"OIDC_USERNAME_CLAIM"`
+	RoleClaim     string            `yaml:"role_claim" env:"OIDC_ROLE_CLAIM"`
+	RoleMap       map[string]string `yaml:"role_map" env:"OIDC_ROLE_MAP"`
+	DefaultRole   string            `yaml:"default_role" env:"OIDC_DEFAULT_ROLE"`
+	Only          bool              `yaml:"only" env:"OIDC_ONLY"`
+}
+
+func newDefaultConfig() *Config {
+	renditionSizes, _ := parseRenditionSizes(defaultRenditionSizes)
+
+	return &Config{
+		Server: ServerConfig{
+			PublicAddress: ":80",
+			AdminAddress:  ":8080",
+			// Reads and writes get long enough for large uploads over slow
+			// connections.
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       10 * time.Minute,
+			WriteTimeout:      10 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Paths: PathsConfig{
+			ImageDirectory:    "./data/images/",
+			DatabaseDirectory: "./data/",
+			DatabaseName:      "picfolio.db",
+		},
+		Images: ImagesConfig{
+			ThumbnailSize:  650,
+			JPEGQuality:    100,
+			RenditionSizes: renditionSizes,
+			WebP:           true,
+		},
+		Storage: StorageConfig{
+			Backend: storageBackendFileSystem,
+			S3: S3Config{
+				UseSSL: true,
+			},
+		},
+		Sessions: SessionsConfig{
+			Store: sessionStoreCookie,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: logFormatJSON,
+		},
+		Uploads: UploadsConfig{
+			MaxFileSize:         200 << 20,
+			MaxRequestSize:      2 << 30,
+			ResumableExpiration: 24 * time.Hour,
+		},
+		Jobs: JobsConfig{
+			Workers:     2,
+			MaxAttempts: 3,
+			RetryDelay:  10 * time.Second,
+			Retention:   7 * 24 * time.Hour,
+		},
+		Janitor: JanitorConfig{
+			Interval:            6 * time.Hour,
+			GracePeriod:         time.Hour,
+			QuarantineRetention: 30 * 24 * time.Hour,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			RoleClaim:     "groups",
+		},
+	}
+}
+
+// loadConfig builds the configuration from args and the environment. It
+// returns the arguments left after the flags, which name a command.
+func loadConfig(args []string) (*Config, []string, error) {
+	config := newDefaultConfig()
+
+	flags := flag.NewFlagSet("picfolio", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("PICFOLIO_CONFIG"), "path to a YAML configuration file")
+	flagValues := registerConfigFlags(flags, reflect.ValueOf(config).Elem())
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		err = loadConfigFile(config, *configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = applyConfigEnv(reflect.ValueOf(config).Elem())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only flags given on the command line override the file and environment.
+	flags.Visit(func(f *flag.Flag) {
+		if field, ok := flagValues[f.Name]; ok && err == nil {
+			err = setConfigValue(field, f.Value.String())
+			if err != nil {
+				err = fmt.Errorf("Invalid value for --%s: %v", f.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, flags.Args(), nil
+}
+
+func loadConfigFile(config *Config, configPath string) error {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read configuration file: %v", err)
+	}
+
+	// Unknown keys are an error so a typo doesn't silently fall back to a
+	// default.
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %v", configPath, err)
+	}
+
+	return nil
+}
+
+// validate checks the whole configuration and reports every problem at once.
+func (c *Config) validate() error {
+	problems := make([]string, 0)
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	addresses := []struct {
+		name  string
+		value string
+	}{
+		{"server.public_address", c.Server.PublicAddress},
+		{"server.admin_address", c.Server.AdminAddress},
+		{"metrics.address", c.Metrics.Address},
+	}
+	usedAddresses := make(map[string]string)
+	for _, address := range addresses {
+		if address.value == "" && address.name == "metrics.address" {
+			continue
+		}
+
+		_, port, err := net.SplitHostPort(address.value)
+		if err != nil {
+			addProblem("%s %q must look like host:port or :port", address.name, address.value)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			addProblem("%s %q has an invalid port", address.name, address.value)
+		}
+
+		if other, ok := usedAddresses[address.value]; ok {
+			addProblem("%s and %s can't both be %q", other, address.name, address.value)
+		}
+		usedAddresses[address.value] = address.name
+	}
+
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			addProblem("server.trusted_proxies %q must be an IP address or CIDR range", proxy)
+		}
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"janitor.interval", c.Janitor.Interval},
+		{"janitor.quarantine_retention", c.Janitor.QuarantineRetention},
+		{"uploads.resumable_expiration", c.Uploads.ResumableExpiration},
+		{"jobs.retry_delay", c.Jobs.RetryDelay},
+		{"jobs.retention", c.Jobs.Retention},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			addProblem("%s can't be negative, got %s", timeout.name, timeout.value)
+		}
+	}
+
+	if c.Uploads.MaxFileSize != 0 && c.Uploads.MaxRequestSize != 0 && c.Uploads.MaxFileSize > c.Uploads.MaxRequestSize {
+		addProblem("uploads.max_file_size %s can't be larger than uploads.max_request_size %s", c.Uploads.MaxFileSize, c.Uploads.MaxRequestSize)
+	}
+
+	if c.Jobs.Workers < 1 {
+		addProblem("jobs.workers must be at least 1, got %d", c.Jobs.Workers)
+	}
+	if c.Jobs.MaxAttempts < 1 {
+		addProblem("jobs.max_attempts must be at least 1, got %d", c.Jobs.MaxAttempts)
+	}
+
+	if c.Janitor.GracePeriod < time.Minute {
+		addProblem("janitor.grace_period must be at least 1m, got %s", c.Janitor.GracePeriod)
+	}
+
+	if c.Paths.ImageDirectory == "" {
+		addProblem("paths.image_directory is required")
+	}
+	if c.Paths.DatabaseDirectory == "" {
+		addProblem("paths.database_directory is required")
+	}
+	if c.Paths.DatabaseName == "" || strings.ContainsAny(c.Paths.DatabaseName, `/\`) {
+		addProblem("paths.database_name must be a file name, got %q", c.Paths.DatabaseName)
+	}
+
+	if c.Images.ThumbnailSize <= 0 {
+		addProblem("images.thumbnail_size must be positive, got %d", c.Images.ThumbnailSize)
+	}
+	if c.Images.JPEGQuality < 1 || c.Images.JPEGQuality > 100 {
+		addProblem("images.jpeg_quality must be between 1 and 100, got %d", c.Images.JPEGQuality)
+	}
+	if len(c.Images.RenditionSizes) == 0 {
+		addProblem("images.rendition_sizes needs at least one size")
+	}
+	renditionSizeCounts := make(map[int]int)
+	for _, size := range c.Images.RenditionSizes {
+		if size <= 0 {
+			addProblem("images.rendition_sizes must be positive, got %d", size)
+		}
+		// Renditions are stored by size, so each can only be made once.
+		renditionSizeCounts[size]++
+		if renditionSizeCounts[size] == 2 {
+			addProblem("images.rendition_sizes lists %d more than once", size)
+		}
+	}
+
+	switch c.Storage.Backend {
+	case storageBackendFileSystem:
+	case storageBackendS3:
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			addProblem("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+	default:
+		addProblem("storage.backend %q must be filesystem or s3", c.Storage.Backend)
+	}
+
+	switch c.Sessions.Store {
+	case sessionStoreCookie, sessionStoreSQLite:
+	default:
+		addProblem("sessions.store %q must be cookie or sqlite", c.Sessions.Store)
+	}
+	if c.Sessions.Keys != "" {
+		if _, err := parseSessionKeys(c.Sessions.Keys); err != nil {
+			addProblem("sessions.keys: %v", err)
+		}
+	}
+
+	if _, err := parseLogLevel(c.Logging.Level); err != nil {
+		addProblem("logging.level %q must be debug, info, warn or error", c.Logging.Level)
+	}
+	if c.Logging.Format != logFormatJSON && c.Logging.Format != logFormatText {
+		addProblem("logging.format %q must be json or text", c.Logging.Format)
+	}
+
+	if c.OIDC.Issuer != "" {
+		if c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+			addProblem("oidc.client_id and oidc.redirect_url are required when oidc.issuer is set")
+		}
+		for value, role := range c.OIDC.RoleMap {
+			if _, err := parseRole(role); err != nil {
+				addProblem("oidc.role_map %q: %v", value, err)
+			}
+		}
+		if c.OIDC.DefaultRole != "" {
+			if _, err := parseRole(c.OIDC.DefaultRole); err != nil {
+				addProblem("oidc.default_role: %v", err)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// registerConfigFlags adds a flag for every field with a flag tag and
+// returns the fields by flag name.
+func registerConfigFlags(flags *flag.FlagSet, value reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+
+	walkConfigFields(value, func(field reflect.Value, tag reflect.StructTag) error {
+		if name := tag.Get("flag"); name != "" {
+			flags.String(name, formatConfigValue(field), fmt.Sprintf("same as the %s environment variable", tag.Get("env")))
+			fields[name] = field
+		}
+		return nil
+	})
+
+	return fields
+}
+
+func applyConfigEnv(value reflect.Value) error {
+	return walkConfigFields(value, func(field reflect.Value, tag reflect.StructTag) error {
+		name := tag.Get("env")
+		if name == "" {
+			return nil
+		}
+
+		envValue, ok := os.LookupEnv(name)
+		if !ok || envValue == "" {
+			return nil
+		}
+
+		err := setConfigValue(field, envValue)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %v", name, err)
+		}
+
+		return nil
+	})
+}
+
+func walkConfigFields(value reflect.Value, visit func(field reflect.Value, tag reflect.StructTag) error) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		tag := value.Type().Field(i).Tag
+
+		var err error
+		if field.Kind() == reflect.Struct {
+			err = walkConfigFields(field, visit)
+		} else {
+			err = visit(field, tag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setConfigValue parses a value from the environment or a flag. Lists are
+// comma separated and maps are comma separated key=value pairs.
+func setConfigValue(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration like 30s or 5m, got %q", value)
+		}
+		field.SetInt(int64(parsed))
+	case bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		field.SetBool(parsed)
+	case ByteSize:
+		parsed, err := parseByteSize(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(parsed))
+	case int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		field.SetInt(int64(parsed))
+	case []int:
+		parsed, err := parseRenditionSizes(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(parsed))
+	case []string:
+		field.Set(reflect.ValueOf(splitConfigList(value)))
+	case map[string]string:
+		parsed := make(map[string]string)
+		for _, pair := range splitConfigList(value) {
+			index := strings.LastIndex(pair, "=")
+			if index <= 0 {
+				return fmt.Errorf("entries must look like key=value, got %q", pair)
+			}
+			parsed[pair[:index]] = pair[index+1:]
+		}
+		field.Set(reflect.ValueOf(parsed))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+func formatConfigValue(field reflect.Value) string {
+	switch value := field.Interface().(type) {
+	case []int:
+		parts := make([]string, len(value))
+		for i, size := range value {
+			parts[i] = strconv.Itoa(size)
+		}
+		return strings.Join(parts, ",")
+	case []string:
+		return strings.Join(value, ",")
+	}
+
+	return fmt.Sprint(field.Interface())
+}
+
+// splitConfigList accepts commas or spaces between items.
+func splitConfigList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessProbePrefix starts the keys written and removed again to
+	// prove storage accepts writes. Each probe uses its own key so
+	// overlapping probes can't delete each other's file.
+	readinessProbePrefix = ".readyz"
+
+	// storageProbeInterval is how long a storage check is reused, so
+	// frequent probes don't turn into a steady stream of writes.
+	storageProbeInterval = 5 * time.Second
+)
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthHandler answers /healthz with whether the database responds, and
+// /readyz with whether the instance can take uploads: the database, the temp
+// directory and storage all accept writes and shutdown hasn't started.
+// Failures are only logged in detail, since the response may be public.
+func healthHandler(a *AppState, ready bool) http.Handler {
+	storageProbe := &storageProbe{Storage: a.Storage, generateID: a.generateID}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := &HealthResponse{Status: "ok", Checks: make(map[string]string)}
+
+		check := func(name string, err error) {
+			if err != nil {
+				getLogger(r).Warn("Health check failed", "check", name, "error", err)
+				response.Status = "unavailable"
+				response.Checks[name] = "unavailable"
+				return
+			}
+			response.Checks[name] = "ok"
+		}
+
+		check("database", a.Repository.ping())
+
+		if ready {
+			check("temp", checkDirectoryWritable(filepath.Join(a.imageDirectoryPath, "temp")))
+			check("storage", storageProbe.check(time.Now()))
+
+			if a.Lifecycle.isStopping() {
+				response.Status = "unavailable"
+				response.Checks["lifecycle"] = "shutting down"
+			}
+		}
+
+		status := http.StatusOK
+		if response.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+func checkDirectoryWritable(directoryPath string) error {
+	file, err := ioutil.TempFile(directoryPath, readinessProbePrefix)
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+
+	return os.Remove(file.Name())
+}
+
+// storageProbe checks that storage accepts writes, reusing the last result
+// for storageProbeInterval.
+type storageProbe struct {
+	Storage    Storage
+	generateID func() string
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (p *storageProbe) check(now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checked.IsZero() && now.Sub(p.checked) < storageProbeInterval {
+		return p.err
+	}
+
+	p.err = checkStorageWritable(p.Storage, readinessProbePrefix+"-"+p.generateID())
+	p.checked = now
+
+	return p.err
+}
+
+func checkStorageWritable(storage Storage, key string) error {
+	err := storage.Put(key, bytes.NewReader([]byte("ok")), 2, "text/plain")
+	if err != nil {
+		return err
+	}
+
+	return storage.Delete(key)
+}
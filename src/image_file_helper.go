@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -13,19 +15,48 @@ import (
 	"strings"
 	"time"
 
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 )
 
+const webpQuality = 80
+
+// imageFileTypes maps the formats image.DecodeConfig recognises to the
+// extension their originals are stored with. The extension decides the
+// Content-Type an original is served with, so it's never taken from the
+// client.
+var imageFileTypes = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+	"webp": "webp",
+}
+
 type UploadProfile struct {
 	FileType *string
 	Path     string
 	Title    *string
 	Size     int64
+	SHA256   *string
 	Height   int
 	Width    int
+	Metadata *ImageMetadata
+}
+
+// UploadError is an upload problem caused by the request, reported to the
+// client as is, while other upload errors are logged and hidden. FileName is
+// set when the problem is with one file rather than the whole request.
+type UploadError struct {
+	Status   int
+	Message  string
+	FileName string
+}
+
+func (e *UploadError) Error() string {
+	return e.Message
 }
 
-func newUploadProfile(path string, fileType *string, title *string, size int64, height int, width int) *UploadProfile {
+func newUploadProfile(path string, fileType *string, title *string, size int64, height int, width int, metadata *ImageMetadata) *UploadProfile {
 	return &UploadProfile{
 		Path:     path,
 		FileType: fileType,
@@ -33,19 +64,132 @@ func newUploadProfile(path string, fileType *string, title *string, size int64,
 		Size:     size,
 		Height:   height,
 		Width:    width,
+		Metadata: metadata,
+	}
+}
+
+// newUploadProfileFromFile describes an image that's already on disk,
+// decoding it to find its metadata and oriented size. The decoded image is
+// returned too, so it doesn't have to be decoded again.
+func newUploadProfileFromFile(filePath string, fileName string) (*UploadProfile, image.Image, error) {
+	size, hash, err := hashFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return readUploadProfile(filePath, fileName, size, &hash)
+}
+
+// newUploadProfileFromUpload describes a file that was just uploaded. Only
+// its header is read, to check that it's an image, leaving the slow work of
+// decoding it to the processing job.
+func newUploadProfileFromUpload(filePath string, fileName string, size int64, hash string) (*UploadProfile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, newUnsupportedImageError(fileName)
+	}
+
+	fileType, ok := imageFileTypes[format]
+	if !ok {
+		return nil, newUnsupportedImageError(fileName)
+	}
+
+	uploadProfile := newUploadProfile(filePath, &fileType, &fileName, size, config.Height, config.Width, &ImageMetadata{})
+	uploadProfile.SHA256 = &hash
+
+	return uploadProfile, nil
+}
+
+func hashFile(filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// readUploadProfile reads the metadata and dimensions of an image file,
+// decoding it from disk. The oriented image is returned with them for
+// making its derived images.
+func readUploadProfile(filePath string, fileName string, size int64, hash *string) (*UploadProfile, image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	metadata := readImageMetadata(file)
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, nil, newUnsupportedImageError(fileName)
+	}
+
+	fileType, ok := imageFileTypes[format]
+	if !ok {
+		return nil, nil, newUnsupportedImageError(fileName)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, err := imaging.Decode(file, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, nil, newUnsupportedImageError(fileName)
 	}
+
+	uploadProfile := newUploadProfile(filePath, &fileType, &fileName, size, img.Bounds().Dy(), img.Bounds().Dx(), metadata)
+	uploadProfile.SHA256 = hash
+
+	return uploadProfile, img, nil
 }
 
-func getEncodingOptions() []imaging.EncodeOption {
+func getEncodingOptions(options *RenditionOptions) []imaging.EncodeOption {
 	return []imaging.EncodeOption{
-		imaging.JPEGQuality(100),
+		imaging.JPEGQuality(options.JPEGQuality),
 	}
 }
 
-func uploadFiles(a *AppState, r *http.Request) ([]*UploadProfile, error) {
+// uploadFiles saves every file in a multipart upload to the temp directory.
+// Files are streamed to disk rather than held in memory, and requests or
+// files past the configured limits are refused with 413. If any file fails,
+// the ones already saved are removed, so an upload is kept whole or not at
+// all.
+func uploadFiles(a *AppState, w http.ResponseWriter, r *http.Request) ([]*UploadProfile, error) {
+	maxRequestSize := a.Config.Uploads.MaxRequestSize
+	if maxRequestSize > 0 {
+		if r.ContentLength > int64(maxRequestSize) {
+			a.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+			return nil, newRequestTooLargeError(maxRequestSize)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxRequestSize))
+	}
+
 	reader, err := r.MultipartReader()
 	if err != nil {
-		return nil, err
+		return nil, &UploadError{Status: http.StatusBadRequest, Message: "Uploads must be sent as multipart/form-data"}
 	}
 
 	uploadProfiles := make([]*UploadProfile, 0)
@@ -55,6 +199,10 @@ func uploadFiles(a *AppState, r *http.Request) ([]*UploadProfile, error) {
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			removeUploadFiles(uploadProfiles)
+			return nil, getUploadReadError(a, err)
+		}
 
 		if part.FileName() == "" {
 			continue
@@ -62,8 +210,8 @@ func uploadFiles(a *AppState, r *http.Request) ([]*UploadProfile, error) {
 
 		uploadProfile, err := uploadFile(a, part)
 		if err != nil {
-			log.Println(err)
-			return uploadProfiles, err
+			removeUploadFiles(uploadProfiles)
+			return nil, err
 		}
 
 		uploadProfiles = append(uploadProfiles, uploadProfile)
@@ -73,142 +221,264 @@ func uploadFiles(a *AppState, r *http.Request) ([]*UploadProfile, error) {
 }
 
 func uploadFile(a *AppState, filePart *multipart.Part) (*UploadProfile, error) {
-	fileType := getFileType(filePart.FileName())
 	fileTitle := filePart.FileName()
+	if !isSupportedFileName(fileTitle) {
+		a.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		return nil, newUnsupportedImageError(fileTitle)
+	}
 
-	tempFileName := getTempFileName(fileTitle)
-	filePath := path.Join(a.imageDirectoryPath, "temp", tempFileName)
+	filePath := path.Join(a.imageDirectoryPath, "temp", getTempFileName(fileTitle))
 
-	buf := &bytes.Buffer{}
-	fileSize, err := io.Copy(buf, filePart)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
+		a.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
 		return nil, err
 	}
 
-	img, err := imaging.Decode(buf, imaging.AutoOrientation(true))
-	if err != nil {
-		return nil, err
+	// One byte past the limit is read so an oversized file can be told apart
+	// from one exactly at the limit.
+	var source io.Reader = filePart
+	maxFileSize := a.Config.Uploads.MaxFileSize
+	if maxFileSize > 0 {
+		source = io.LimitReader(filePart, int64(maxFileSize)+1)
 	}
 
-	height := img.Bounds().Dy()
-	width := img.Bounds().Dx()
+	hasher := sha256.New()
+	fileSize, err := io.Copy(io.MultiWriter(file, hasher), source)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		os.Remove(filePath)
+		a.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
+		return nil, closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return nil, getUploadReadError(a, err)
+	}
+	if maxFileSize > 0 && fileSize > int64(maxFileSize) {
+		os.Remove(filePath)
+		a.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		return nil, newFileTooLargeError(fileTitle, maxFileSize)
+	}
 
-	err = imaging.Save(img, filePath, getEncodingOptions()...)
+	// The original bytes are kept untouched as the master copy, orientation
+	// is only applied to the derived images.
+	uploadProfile, err := newUploadProfileFromUpload(filePath, fileTitle, fileSize, hex.EncodeToString(hasher.Sum(nil)))
 	if err != nil {
+		os.Remove(filePath)
+		if _, ok := err.(*UploadError); ok {
+			a.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		} else {
+			a.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
+		}
 		return nil, err
 	}
 
-	uploadProfile := newUploadProfile(filePath, &fileType, &fileTitle, fileSize, height, width)
+	a.Metrics.UploadsTotal.WithLabelValues("accepted").Inc()
+	a.Metrics.UploadBytesTotal.Add(float64(fileSize))
 
 	return uploadProfile, nil
 }
 
-func moveFile(sourcePath string, destPath string) error {
-	inputFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("Couldn't open source file: %s", err)
+// getUploadReadError explains a failure reading the request body, which is
+// either the request passing its size limit or the client going away.
+func getUploadReadError(a *AppState, err error) error {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		a.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		return newRequestTooLargeError(a.Config.Uploads.MaxRequestSize)
 	}
 
-	outputFile, err := os.Create(destPath)
-	if err != nil {
-		inputFile.Close()
-		return fmt.Errorf("Couldn't open dest file: %s", err)
-	}
-	defer outputFile.Close()
+	a.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
+	return &UploadError{Status: http.StatusBadRequest, Message: "The upload was incomplete or malformed"}
+}
 
-	_, err = io.Copy(outputFile, inputFile)
-	inputFile.Close()
-	if err != nil {
-		return fmt.Errorf("Writing to output file failed: %s", err)
-	}
+func newRequestTooLargeError(maxRequestSize ByteSize) *UploadError {
+	return &UploadError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("The upload is larger than the %s limit for a request", maxRequestSize)}
+}
 
-	err = os.Remove(sourcePath)
-	if err != nil {
-		return fmt.Errorf("Failed removing original file: %s", err)
-	}
+func newFileTooLargeError(fileName string, maxFileSize ByteSize) *UploadError {
+	return &UploadError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("%s is larger than the %s limit for a file", fileName, maxFileSize), FileName: fileName}
+}
 
-	return nil
+func newUnsupportedImageError(fileName string) *UploadError {
+	return &UploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf("%s isn't a supported image", fileName), FileName: fileName}
 }
 
-func deleteImage(imagePath string) error {
-	if _, err := os.Stat(imagePath); err != nil {
-		return nil
+// removeUploadFiles deletes the temp files of uploads that won't be turned
+// into images.
+func removeUploadFiles(uploadProfiles []*UploadProfile) {
+	for _, uploadProfile := range uploadProfiles {
+		os.Remove(uploadProfile.Path)
 	}
+}
 
-	err := os.Remove(imagePath)
+func deleteImage(storage Storage, imageKey string) error {
+	// Derived images share the original's key up to the extension.
+	err := deleteStoragePrefix(storage, getKeyWithoutExtension(imageKey)+".")
 	if err != nil {
 		return err
 	}
 
-	err = deleteThumbnailImage(imagePath)
+	return nil
+}
+
+func openStorageImage(storage Storage, imageKey string) (image.Image, error) {
+	reader, err := storage.Get(imageKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer reader.Close()
 
-	return nil
+	return imaging.Decode(reader, imaging.AutoOrientation(true))
 }
 
-func deleteThumbnailImage(imagePath string) error {
-	thumbPath := getThumbnailFilePath(imagePath)
+func saveStorageImage(storage Storage, img image.Image, imageKey string, options *RenditionOptions) (int64, error) {
+	buf := &bytes.Buffer{}
 
-	if _, err := os.Stat(thumbPath); err == nil {
-		err = os.Remove(thumbPath)
+	if strings.HasSuffix(imageKey, ".webp") {
+		err := webp.Encode(buf, img, &webp.Options{Quality: webpQuality})
 		if err != nil {
-			return err
+			return 0, err
+		}
+	} else {
+		format, err := imaging.FormatFromFilename(imageKey)
+		if err != nil {
+			return 0, err
+		}
+
+		err = imaging.Encode(buf, img, format, getEncodingOptions(options)...)
+		if err != nil {
+			return 0, err
 		}
 	}
 
-	return nil
-}
+	size := int64(buf.Len())
 
-func rotateImageCCW(imagePath string) error {
-	img, err := imaging.Open(imagePath, imaging.AutoOrientation(true))
+	err := storage.Put(imageKey, buf, size, getContentType(imageKey))
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// rotateImage turns an oriented image counter-clockwise by the given number of
+// degrees, which must be a multiple of 90.
+func rotateImage(img image.Image, rotation int) image.Image {
+	switch rotation % 360 {
+	case 90:
+		return imaging.Rotate90(img)
+	case 180:
+		return imaging.Rotate180(img)
+	case 270:
+		return imaging.Rotate270(img)
 	}
 
-	rotatedImg := imaging.Rotate90(img)
+	return img
+}
+
+func makeDerivedImages(storage Storage, imageKey string, rotation int, options *RenditionOptions) ([]*RenditionRecord, error) {
+	img, err := openStorageImage(storage, imageKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = imaging.Save(rotatedImg, imagePath, getEncodingOptions()...)
+	return makeDerivedImagesFromImage(storage, rotateImage(img, rotation), imageKey, options)
+}
+
+func makeDerivedImagesFromImage(storage Storage, img image.Image, imageKey string, options *RenditionOptions) ([]*RenditionRecord, error) {
+	renditions, err := makeRenditionsFromImage(storage, img, imageKey, options)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = makeThumbnailFromImage(rotatedImg, imagePath)
+	err = makeThumbnailFromImage(storage, img, imageKey, options)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return renditions, nil
 }
 
-func makeThumbnailImage(imagePath string) error {
-	img, err := imaging.Open(imagePath)
-	if err != nil {
-		return err
+func makeRenditionsFromImage(storage Storage, img image.Image, imageKey string, options *RenditionOptions) ([]*RenditionRecord, error) {
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+
+	renditions := make([]*RenditionRecord, 0)
+
+	for _, size := range getRenditionSizes(options.Sizes, width, height) {
+		renditionImg := imaging.Fit(img, size, size, imaging.Lanczos)
+		renditionKey := getRenditionFilePath(imageKey, size)
+
+		fileSize, err := saveStorageImage(storage, renditionImg, renditionKey, options)
+		if err != nil {
+			return nil, err
+		}
+
+		rendition := &RenditionRecord{
+			Size:   size,
+			Path:   renditionKey,
+			Width:  renditionImg.Bounds().Dx(),
+			Height: renditionImg.Bounds().Dy(),
+			Bytes:  fileSize,
+		}
+
+		if options.WebP {
+			webpKey := getWebPFilePath(renditionKey)
+
+			webpSize, err := saveStorageImage(storage, renditionImg, webpKey, options)
+			if err != nil {
+				return nil, err
+			}
+
+			rendition.WebPPath = &webpKey
+			rendition.WebPBytes = &webpSize
+		}
+
+		renditions = append(renditions, rendition)
 	}
 
-	err = makeThumbnailFromImage(img, imagePath)
+	return renditions, nil
+}
+
+func makeThumbnailFromImage(storage Storage, img image.Image, imageKey string, options *RenditionOptions) error {
+	thumbImg := imaging.Fit(img, options.ThumbnailSize, options.ThumbnailSize, imaging.Lanczos)
+	thumbKey := getThumbnailFilePath(imageKey)
+
+	_, err := saveStorageImage(storage, thumbImg, thumbKey, options)
 	if err != nil {
 		return err
 	}
 
+	if options.WebP {
+		_, err = saveStorageImage(storage, thumbImg, getWebPFilePath(thumbKey), options)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func makeThumbnailFromImage(img image.Image, imagePath string) error {
-	thumbImg := imaging.Fit(img, 650, 650, imaging.Lanczos)
-	thumbPath := getThumbnailFilePath(imagePath)
+// getRenditionSizes returns the configured sizes worth generating for an
+// image. Sizes past the first one that holds the full image would only be
+// upscaled copies, so they are left out.
+func getRenditionSizes(sizes []int, width int, height int) []int {
+	longestSide := width
+	if height > longestSide {
+		longestSide = height
+	}
 
-	err := imaging.Save(thumbImg, thumbPath, getEncodingOptions()...)
-	if err != nil {
-		return err
+	renditionSizes := make([]int, 0)
+
+	for _, size := range sizes {
+		renditionSizes = append(renditionSizes, size)
+		if size >= longestSide {
+			break
+		}
 	}
 
-	return nil
+	return renditionSizes
 }
 
 func getTempFileName(fileName string) string {
@@ -220,11 +490,37 @@ func getTempFileName(fileName string) string {
 }
 
 func getThumbnailFilePath(fileName string) string {
+	return fmt.Sprintf("%s.thumb.jpg", getKeyWithoutExtension(fileName))
+}
+
+func getDisplayFilePath(fileName string) string {
+	return fmt.Sprintf("%s.display.jpg", getKeyWithoutExtension(fileName))
+}
+
+func getRenditionFilePath(fileName string, size int) string {
+	return fmt.Sprintf("%s.%d.jpg", getKeyWithoutExtension(fileName), size)
+}
+
+func getWebPFilePath(fileName string) string {
+	return fmt.Sprintf("%s.webp", getKeyWithoutExtension(fileName))
+}
+
+func getKeyWithoutExtension(fileName string) string {
 	parts := strings.Split(fileName, ".")
-	return fmt.Sprintf("%s.thumb.jpg", strings.Join(parts[:len(parts)-1], "."))
+	return strings.Join(parts[:len(parts)-1], ".")
 }
 
 func getFileType(fileName string) string {
 	nameParts := strings.Split(fileName, ".")
 	return nameParts[len(nameParts)-1]
 }
+
+// isSupportedFileName checks an upload is named as an image, so other files
+// can be turned away before they're received.
+func isSupportedFileName(fileName string) bool {
+	switch strings.ToLower(getFileType(fileName)) {
+	case "jpg", "jpeg", "png", "gif", "webp":
+		return strings.Contains(strings.Trim(fileName, "."), ".")
+	}
+	return false
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 	"path"
+	"path/filepath"
+	"time"
 )
 
+var errImageNotFound = errors.New("Image not found")
+var errImageProcessing = errors.New("The image is still being processed")
+var errCoverPhotoNotInAlbum = errors.New("Cover photo must be an image in this album")
+
 type ImageManager struct {
 	AppState     *AppState
 	Repository   *Repository
@@ -19,35 +30,137 @@ func newImageManager(a *AppState) *ImageManager {
 	}
 }
 
+// createImage stores an upload's original and records it as processing,
+// together with the job that reads its metadata and makes its derived
+// images. The file is written before the record that refers to it, so a
+// failure at any step only has to remove the new file to leave the library
+// as it was.
 func (m *ImageManager) createImage(albumID string, uploadProfile *UploadProfile) (string, error) {
 	imageID := m.AppState.generateID()
-	imagePath := m.getImagePath(albumID, imageID, uploadProfile.FileType)
+	imageKey := m.getImageKey(albumID, imageID, uploadProfile.FileType)
+	defer os.Remove(uploadProfile.Path)
 
-	err := moveFile(uploadProfile.Path, imagePath)
+	err := putStorageFile(m.AppState.Storage, uploadProfile.Path, imageKey)
+	if err == nil {
+		job := &JobRecord{ID: m.AppState.generateID(), Kind: jobProcessImage}
+		err = m.Repository.createImageRecord(imageID, imageKey, uploadProfile.Title, uploadProfile.Size, uploadProfile.SHA256, uploadProfile.FileType, albumID, uploadProfile.Height, uploadProfile.Width, imageStatusProcessing, uploadProfile.Metadata, nil, job)
+	}
 	if err != nil {
+		m.deleteImageFiles(imageKey)
 		return "", err
 	}
 
-	err = m.Repository.createImageRecord(imageID, imagePath, uploadProfile.Title, uploadProfile.Size, uploadProfile.FileType, albumID, uploadProfile.Height, uploadProfile.Width)
+	m.AppState.JobQueue.notify()
+
+	m.publishImageEvent(uploadEventReceived, &ImageRecord{
+		ID:       imageID,
+		Path:     imageKey,
+		Title:    uploadProfile.Title,
+		Status:   imageStatusProcessing,
+		AlbumID:  albumID,
+		Height:   uploadProfile.Height,
+		Width:    uploadProfile.Width,
+		Metadata: *uploadProfile.Metadata,
+	}, "")
+
+	return imageID, nil
+}
+
+// processImage reads an uploaded original's metadata and orientation and
+// makes its derived images, after which the image is ready to show.
+func (m *ImageManager) processImage(imageID string) error {
+	image, err := m.Repository.getImageRecord(imageID)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if image == nil {
+		return errImageNotFound
 	}
 
-	err = makeThumbnailImage(imagePath)
+	tempFilePath := filepath.Join(m.AppState.imageDirectoryPath, "temp", getTempFileName(path.Base(image.Path)))
+	defer os.Remove(tempFilePath)
+
+	err = getStorageFile(m.AppState.Storage, image.Path, tempFilePath)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	err = m.AlbumManager.setAlbumCoverPhotoIfUnset(albumID, imageID)
+	fileName := path.Base(image.Path)
+	if image.Title != nil {
+		fileName = *image.Title
+	}
+
+	uploadProfile, img, err := readUploadProfile(tempFilePath, fileName, image.Size, image.SHA256)
 	if err != nil {
-		return "", err
+		return err
 	}
+	m.publishImageEvent(uploadEventDecoded, image, "")
 
-	return imageID, nil
+	start := time.Now()
+	renditions, err := makeDerivedImagesFromImage(m.AppState.Storage, img, image.Path, m.AppState.RenditionOptions)
+	m.AppState.Metrics.observeProcessing("upload", start, err)
+	if err != nil {
+		return err
+	}
+	m.publishImageEvent(uploadEventThumbnailed, image, "")
+
+	err = m.Repository.completeImageRecord(imageID, uploadProfile.Height, uploadProfile.Width, uploadProfile.Metadata, renditions)
+	if err == errImageNotFound {
+		m.deleteImageFiles(image.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	image, err = m.getImage(imageID)
+	if err != nil || image == nil {
+		slog.Warn("Unable to load processed image", "image_id", imageID, "error", err)
+		return nil
+	}
+	m.publishImageEvent(uploadEventDone, image, "")
+
+	return nil
+}
+
+// publishImageEvent tells the admin pages watching the image's album how
+// its processing is going. Received and done events carry the image for the
+// photo grid.
+func (m *ImageManager) publishImageEvent(eventType string, image *ImageRecord, reason string) {
+	event := &UploadEvent{
+		Type:    eventType,
+		AlbumID: image.AlbumID,
+		ImageID: image.ID,
+		Reason:  reason,
+	}
+
+	if image.Title != nil {
+		event.FileName = *image.Title
+	}
+
+	if eventType == uploadEventReceived || eventType == uploadEventDone {
+		event.Photo = newGridPhoto(image)
+	}
+
+	m.AppState.UploadEvents.publish(event)
+}
+
+// deleteImageFiles removes an image's original and derived files. It's only
+// called once no record refers to them, so a failure leaves unused files
+// behind rather than a broken image, and is logged instead of returned.
+func (m *ImageManager) deleteImageFiles(imageKey string) {
+	err := deleteImage(m.AppState.Storage, imageKey)
+	if err != nil {
+		slog.Warn("Unable to delete image files", "key", imageKey, "error", err)
+	}
 }
 
 func (m *ImageManager) getImage(imageID string) (*ImageRecord, error) {
 	image, err := m.Repository.getImageRecord(imageID)
+	if err != nil || image == nil {
+		return nil, err
+	}
+
+	image.Renditions, err = m.Repository.getRenditionRecordsByImageID(imageID)
 	if err != nil {
 		return nil, err
 	}
@@ -55,85 +168,244 @@ func (m *ImageManager) getImage(imageID string) (*ImageRecord, error) {
 	return image, nil
 }
 
+// isAlbumImage checks imageID is an image in the album, as a cover photo
+// has to be.
+func (m *ImageManager) isAlbumImage(albumID string, imageID string) (bool, error) {
+	image, err := m.Repository.getImageRecord(imageID)
+	if err != nil {
+		return false, err
+	}
+
+	return image != nil && image.AlbumID == albumID, nil
+}
+
 func (m *ImageManager) getAllImagesByAlbumID(albumID string) ([]*ImageRecord, error) {
 	images, err := m.Repository.getAllImageRecordsByAlbumID(albumID)
 	if err != nil {
 		return nil, err
 	}
 
+	renditions, err := m.Repository.getAllRenditionRecordsByAlbumID(albumID)
+	if err != nil {
+		return nil, err
+	}
+
+	attachRenditions(images, renditions)
+
 	return images, nil
 }
 
 func (m *ImageManager) deleteImage(imageID string) error {
-	image, err := m.getImage(imageID)
+	image, err := m.Repository.getImageRecord(imageID)
 	if err != nil {
 		return err
 	}
+	if image == nil {
+		return errImageNotFound
+	}
 
-	album, err := m.AlbumManager.getAlbum(image.AlbumID)
+	// The record goes first, along with any cover that used it, so the
+	// library never refers to files that are gone.
+	err = m.Repository.deleteImage(imageID)
 	if err != nil {
 		return err
 	}
 
-	err = deleteImage(image.Path)
+	m.deleteImageFiles(image.Path)
+
+	return nil
+}
+
+// discardImages deletes the images already created for an upload that
+// failed part way. A failure is logged, leaving the image for the user to
+// delete.
+func (m *ImageManager) discardImages(albumID string, imageIDs []string) {
+	for _, imageID := range imageIDs {
+		err := m.deleteImage(imageID)
+		if err != nil {
+			slog.Warn("Unable to delete image from failed upload", "image_id", imageID, "error", err)
+			continue
+		}
+
+		m.AppState.UploadEvents.publish(&UploadEvent{
+			Type:    uploadEventFailed,
+			AlbumID: albumID,
+			ImageID: imageID,
+			Reason:  "The rest of the upload failed",
+		})
+	}
+}
+
+func (m *ImageManager) updateImage(imageID string, image *ImageRecord) error {
+	err := m.Repository.updateImage(imageID, image)
 	if err != nil {
 		return err
 	}
 
-	err = m.Repository.deleteImage(imageID)
+	return nil
+}
+
+func (m *ImageManager) rotateImage(imageID string) error {
+	err := m.Repository.rotateImageRecord(imageID, &JobRecord{ID: m.AppState.generateID(), Kind: jobRotateImage})
 	if err != nil {
 		return err
 	}
 
-	if *(album.CoverPhotoID) == imageID {
-		images, err := m.Repository.getAllImageRecordsByAlbumID(album.ID)
-		if err != nil {
-			return nil
+	m.AppState.JobQueue.notify()
+
+	return nil
+}
+
+func (m *ImageManager) getOriginalImage(imageID string) (*ImageRecord, io.ReadCloser, error) {
+	image, err := m.Repository.getImageRecord(imageID)
+	if err != nil || image == nil {
+		return nil, nil, err
+	}
+
+	reader, err := m.AppState.Storage.Get(image.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return image, reader, nil
+}
+
+// generateMissingDerivedImages queues backfilling the renditions of images
+// created before they existed or before the configured rendition sizes
+// changed. It stops between images once ctx is cancelled.
+func (m *ImageManager) generateMissingDerivedImages(ctx context.Context) {
+	images, err := m.Repository.getAllImageRecords()
+	if err != nil {
+		slog.Error("Unable to load images for rendition backfill", "error", err)
+		return
+	}
+
+	renditions, err := m.Repository.getAllRenditionRecords()
+	if err != nil {
+		slog.Error("Unable to load renditions for rendition backfill", "error", err)
+		return
+	}
+
+	attachRenditions(images, renditions)
+
+	for _, image := range images {
+		if ctx.Err() != nil {
+			return
 		}
 
-		if len(images) > 0 {
-			err = m.AlbumManager.setAlbumCoverPhoto(album.ID, images[0].ID)
-			if err != nil {
-				return nil
-			}
+		if image.Status != imageStatusReady || isRenditionSetCurrent(image, m.AppState.RenditionOptions) {
+			continue
+		}
+
+		err := m.AppState.JobQueue.enqueue(jobRegenerateImage, image.ID)
+		if err != nil {
+			slog.Error("Unable to queue rendition backfill", "image_id", image.ID, "error", err)
 		}
 	}
+}
 
-	return nil
+// regenerateDerivedImages rebuilds an image's thumbnail and renditions from
+// its original, for example after they went missing from storage.
+func (m *ImageManager) regenerateDerivedImages(imageID string, operation string) error {
+	image, err := m.getImage(imageID)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return errImageNotFound
+	}
+
+	return m.refreshDerivedImages(image, operation)
 }
 
-func (m *ImageManager) updateImage(imageID string, image *ImageRecord) error {
-	err := m.Repository.updateImage(imageID, image)
+func (m *ImageManager) refreshDerivedImages(image *ImageRecord, operation string) error {
+	start := time.Now()
+	renditions, err := makeDerivedImages(m.AppState.Storage, image.Path, image.Rotation, m.AppState.RenditionOptions)
+	m.AppState.Metrics.observeProcessing(operation, start, err)
+	if err != nil {
+		return err
+	}
+
+	err = m.Repository.setRenditionRecords(image.ID, renditions)
+	if err == errImageNotFound {
+		m.deleteImageFiles(image.Path)
+	}
 	if err != nil {
 		return err
 	}
 
+	m.deleteStaleRenditions(image, renditions)
+
 	return nil
 }
 
-func (m *ImageManager) rotateImage(imageID string) error {
-	record, err := m.Repository.getImageRecord(imageID)
+// reattachImage records an original found in storage without a record. It
+// keeps the file's key and ID so links that still point at it work again.
+func (m *ImageManager) reattachImage(albumID string, imageID string, imageKey string) error {
+	tempFilePath := filepath.Join(m.AppState.imageDirectoryPath, "temp", getTempFileName(path.Base(imageKey)))
+	defer os.Remove(tempFilePath)
+
+	err := getStorageFile(m.AppState.Storage, imageKey, tempFilePath)
 	if err != nil {
 		return err
 	}
 
-	err = rotateImageCCW(record.Path)
+	uploadProfile, img, err := newUploadProfileFromFile(tempFilePath, path.Base(imageKey))
 	if err != nil {
 		return err
 	}
 
-	temp := record.Height
-	record.Height = record.Width
-	record.Width = temp
-
-	err = m.Repository.updateImage(imageID, record)
+	start := time.Now()
+	renditions, err := makeDerivedImagesFromImage(m.AppState.Storage, img, imageKey, m.AppState.RenditionOptions)
+	m.AppState.Metrics.observeProcessing("repair", start, err)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return m.Repository.createImageRecord(imageID, imageKey, uploadProfile.Title, uploadProfile.Size, uploadProfile.SHA256, uploadProfile.FileType, albumID, uploadProfile.Height, uploadProfile.Width, imageStatusReady, uploadProfile.Metadata, renditions, nil)
+}
+
+func (m *ImageManager) deleteStaleRenditions(image *ImageRecord, renditions []*RenditionRecord) {
+	staleKeys := []string{getDisplayFilePath(image.Path)}
+
+	for _, previous := range image.Renditions {
+		isCurrent := false
+		for _, rendition := range renditions {
+			if rendition.Path == previous.Path {
+				isCurrent = true
+				break
+			}
+		}
+
+		if !isCurrent {
+			staleKeys = append(staleKeys, previous.Path)
+			if previous.WebPPath != nil {
+				staleKeys = append(staleKeys, *previous.WebPPath)
+			}
+		}
+	}
+
+	for _, key := range staleKeys {
+		err := m.AppState.Storage.Delete(key)
+		if err != nil {
+			slog.Warn("Unable to delete stale rendition", "key", key, "error", err)
+		}
+	}
+}
+
+func attachRenditions(images []*ImageRecord, renditions []*RenditionRecord) {
+	imagesByID := make(map[string]*ImageRecord)
+	for _, image := range images {
+		imagesByID[image.ID] = image
+	}
+
+	for _, rendition := range renditions {
+		if image, ok := imagesByID[rendition.ImageID]; ok {
+			image.Renditions = append(image.Renditions, rendition)
+		}
+	}
 }
 
-func (m *ImageManager) getImagePath(albumID string, imageID string, fileType *string) string {
-	return path.Join(m.AlbumManager.getAlbumPath(albumID), fmt.Sprintf("%s.%s", imageID, *fileType))
+func (m *ImageManager) getImageKey(albumID string, imageID string, fileType *string) string {
+	return path.Join(m.AlbumManager.getAlbumKey(albumID), fmt.Sprintf("%s.%s", imageID, *fileType))
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const (
+	jpegMarkerSOI   = 0xD8
+	jpegMarkerEOI   = 0xD9
+	jpegMarkerSOS   = 0xDA
+	jpegMarkerAPP1  = 0xE1
+	jpegMarkerAPP13 = 0xED
+
+	xmpNamespace       = "http://ns.adobe.com/xap/1.0/\x00"
+	photoshopNamespace = "Photoshop 3.0\x00"
+	dublinCoreURI      = "http://purl.org/dc/elements/1.1/"
+	rdfURI             = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+	iptcResourceID         = 0x0404
+	iptcRecordApplication  = 2
+	iptcDatasetObjectName  = 5
+	iptcDatasetKeywords    = 25
+	iptcDatasetByline      = 80
+	iptcDatasetCopyright   = 116
+	iptcDatasetCaption     = 120
+	iptcTagMarker          = 0x1C
+	maxJPEGSegmentsScanned = 64
+)
+
+// ImageMetadata holds the shooting details and descriptive fields read from
+// the EXIF, IPTC and XMP blocks of an uploaded file.
+type ImageMetadata struct {
+	Captured     *time.Time `json:"captured,omitempty"`
+	CameraMake   *string    `json:"cameraMake,omitempty"`
+	CameraModel  *string    `json:"cameraModel,omitempty"`
+	LensModel    *string    `json:"lensModel,omitempty"`
+	ExposureTime *string    `json:"exposureTime,omitempty"`
+	FNumber      *float64   `json:"fNumber,omitempty"`
+	FocalLength  *float64   `json:"focalLength,omitempty"`
+	ISO          *int       `json:"iso,omitempty"`
+	Latitude     *float64   `json:"latitude,omitempty"`
+	Longitude    *float64   `json:"longitude,omitempty"`
+	Headline     *string    `json:"headline,omitempty"`
+	Caption      *string    `json:"caption,omitempty"`
+	Creator      *string    `json:"creator,omitempty"`
+	Copyright    *string    `json:"copyright,omitempty"`
+	Keywords     *string    `json:"keywords,omitempty"`
+}
+
+// WithoutLocation is the metadata the public server shows. Where a photo was
+// taken can give away someone's home, so it's only shown to signed in users.
+func (m ImageMetadata) WithoutLocation() ImageMetadata {
+	m.Latitude = nil
+	m.Longitude = nil
+	return m
+}
+
+// readImageMetadata extracts whatever metadata the file carries. Files without
+// metadata, or with blocks we can't parse, yield empty fields rather than an
+// error so they can still be uploaded.
+func readImageMetadata(reader io.ReadSeeker) *ImageMetadata {
+	metadata := &ImageMetadata{}
+
+	if _, err := reader.Seek(0, io.SeekStart); err == nil {
+		if x, err := exif.Decode(reader); err == nil {
+			readEXIFMetadata(x, metadata)
+		}
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err == nil {
+		xmpData, iptcData := readJPEGMetadataSegments(reader)
+		if iptcData != nil {
+			readIPTCMetadata(iptcData, metadata)
+		}
+		if xmpData != nil {
+			readXMPMetadata(xmpData, metadata)
+		}
+	}
+
+	return metadata
+}
+
+func readEXIFMetadata(x *exif.Exif, metadata *ImageMetadata) {
+	if captured, err := x.DateTime(); err == nil {
+		metadata.Captured = &captured
+	}
+
+	metadata.CameraMake = getEXIFString(x, exif.Make)
+	metadata.CameraModel = getEXIFString(x, exif.Model)
+	metadata.LensModel = getEXIFString(x, exif.LensModel)
+	metadata.FNumber = getEXIFFloat(x, exif.FNumber)
+	metadata.FocalLength = getEXIFFloat(x, exif.FocalLength)
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if rat, err := tag.Rat(0); err == nil && rat.Sign() > 0 {
+			exposureTime := formatExposureTime(rat)
+			metadata.ExposureTime = &exposureTime
+		}
+	}
+
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			metadata.ISO = &iso
+		}
+	}
+
+	if lat, long, err := x.LatLong(); err == nil {
+		metadata.Latitude = &lat
+		metadata.Longitude = &long
+	}
+}
+
+func getEXIFString(x *exif.Exif, name exif.FieldName) *string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return nil
+	}
+
+	value, err := tag.StringVal()
+	if err != nil {
+		return nil
+	}
+
+	return nilString(strings.TrimSpace(strings.TrimRight(value, "\x00")))
+}
+
+func getEXIFFloat(x *exif.Exif, name exif.FieldName) *float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return nil
+	}
+
+	rat, err := tag.Rat(0)
+	if err != nil || rat.Sign() <= 0 {
+		return nil
+	}
+
+	value, _ := rat.Float64()
+	return &value
+}
+
+func formatExposureTime(rat *big.Rat) string {
+	seconds, _ := rat.Float64()
+	if seconds >= 1 {
+		return fmt.Sprintf("%g", seconds)
+	}
+
+	return fmt.Sprintf("1/%.0f", 1/seconds)
+}
+
+// readJPEGMetadataSegments walks the JPEG markers up to the start of the scan
+// and returns the XMP packet and the IPTC block, if present.
+func readJPEGMetadataSegments(reader io.Reader) ([]byte, []byte) {
+	var xmpData, iptcData []byte
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0xFF || header[1] != jpegMarkerSOI {
+		return nil, nil
+	}
+
+	for i := 0; i < maxJPEGSegmentsScanned; i++ {
+		if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0xFF {
+			break
+		}
+
+		marker := header[1]
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			continue
+		}
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		length := int64(binary.BigEndian.Uint16(header)) - 2
+		if length < 0 {
+			break
+		}
+
+		if marker != jpegMarkerAPP1 && marker != jpegMarkerAPP13 {
+			if _, err := io.CopyN(ioutil.Discard, reader, length); err != nil {
+				break
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			break
+		}
+
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(segment, []byte(xmpNamespace)) {
+			xmpData = segment[len(xmpNamespace):]
+		} else if marker == jpegMarkerAPP13 && bytes.HasPrefix(segment, []byte(photoshopNamespace)) {
+			iptcData = findPhotoshopResource(segment[len(photoshopNamespace):], iptcResourceID)
+		}
+	}
+
+	return xmpData, iptcData
+}
+
+func findPhotoshopResource(data []byte, resourceID uint16) []byte {
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// Pascal string name, padded so name and length byte are even.
+		nameLength := int(data[6]) + 1
+		if nameLength%2 != 0 {
+			nameLength++
+		}
+
+		offset := 6 + nameLength
+		if len(data) < offset+4 {
+			return nil
+		}
+
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		if size < 0 || len(data) < offset+size {
+			return nil
+		}
+
+		if id == resourceID {
+			return data[offset : offset+size]
+		}
+
+		if size%2 != 0 {
+			size++
+		}
+		if len(data) < offset+size {
+			return nil
+		}
+		data = data[offset+size:]
+	}
+
+	return nil
+}
+
+func readIPTCMetadata(data []byte, metadata *ImageMetadata) {
+	keywords := make([]string, 0)
+
+	for len(data) >= 5 && data[0] == iptcTagMarker {
+		record := data[1]
+		dataset := data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+
+		// Extended datasets aren't used by the text fields we read.
+		if size&0x8000 != 0 || len(data) < 5+size {
+			break
+		}
+
+		value := strings.TrimSpace(string(data[5 : 5+size]))
+		data = data[5+size:]
+
+		if record != iptcRecordApplication || value == "" {
+			continue
+		}
+
+		switch dataset {
+		case iptcDatasetObjectName:
+			metadata.Headline = nilString(value)
+		case iptcDatasetKeywords:
+			keywords = append(keywords, value)
+		case iptcDatasetByline:
+			metadata.Creator = nilString(value)
+		case iptcDatasetCopyright:
+			metadata.Copyright = nilString(value)
+		case iptcDatasetCaption:
+			metadata.Caption = nilString(value)
+		}
+	}
+
+	if len(keywords) > 0 {
+		metadata.Keywords = nilString(strings.Join(keywords, ", "))
+	}
+}
+
+// readXMPMetadata reads the Dublin Core properties from an XMP packet. These
+// take precedence over IPTC since XMP is what current editors write.
+func readXMPMetadata(data []byte, metadata *ImageMetadata) {
+	values := make(map[string][]string)
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	property := ""
+	text := ""
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space == dublinCoreURI {
+				property = t.Name.Local
+			}
+			text = ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			if property == "" {
+				continue
+			}
+
+			isValue := (t.Name.Space == rdfURI && t.Name.Local == "li") || (t.Name.Space == dublinCoreURI && t.Name.Local == property)
+			value := strings.TrimSpace(text)
+			if isValue && value != "" {
+				values[property] = append(values[property], value)
+			}
+
+			if t.Name.Space == dublinCoreURI && t.Name.Local == property {
+				property = ""
+			}
+			text = ""
+		}
+	}
+
+	setFirstXMPValue(values, "title", &metadata.Headline)
+	setFirstXMPValue(values, "description", &metadata.Caption)
+	setFirstXMPValue(values, "rights", &metadata.Copyright)
+
+	if creators, ok := values["creator"]; ok {
+		metadata.Creator = nilString(strings.Join(creators, ", "))
+	}
+	if subjects, ok := values["subject"]; ok {
+		metadata.Keywords = nilString(strings.Join(subjects, ", "))
+	}
+}
+
+func setFirstXMPValue(values map[string][]string, property string, target **string) {
+	if propertyValues, ok := values[property]; ok && len(propertyValues) > 0 {
+		*target = nilString(propertyValues[0])
+	}
+}
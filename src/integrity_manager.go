@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	integrityOrphanFile       = "orphan_file"
+	integrityMissingOriginal  = "missing_original"
+	integrityMissingThumbnail = "missing_thumbnail"
+	integrityMissingRendition = "missing_rendition"
+	integrityDanglingCover    = "dangling_cover"
+	integrityStaleTemp        = "stale_temp"
+)
+
+const (
+	integrityActionDelete     = "delete"
+	integrityActionReattach   = "re-attach"
+	integrityActionRegenerate = "regenerate"
+	integrityActionResetCover = "reset cover"
+)
+
+// IntegrityIssue is one problem found in the library and the action --fix
+// takes for it.
+type IntegrityIssue struct {
+	Kind    string
+	Action  string
+	Key     string
+	AlbumID string
+	ImageID string
+	Bytes   int64
+	Detail  string
+	Error   string
+	Fixed   bool
+}
+
+type IntegrityReport struct {
+	Checked time.Time
+	// GracePeriod keeps the checker away from work in progress. An upload
+	// writes its files before its record, so files and records younger than
+	// this are left alone.
+	GracePeriod time.Duration
+	Albums      int
+	Images      int
+	Files       int
+	Issues      []*IntegrityIssue
+}
+
+// IntegrityManager compares the database with storage and the temp
+// directory, and repairs what doesn't match.
+type IntegrityManager struct {
+	AppState     *AppState
+	Repository   *Repository
+	ImageManager *ImageManager
+}
+
+func newIntegrityManager(a *AppState) *IntegrityManager {
+	return &IntegrityManager{
+		AppState:     a,
+		Repository:   a.Repository,
+		ImageManager: a.ImageManager,
+	}
+}
+
+func (m *IntegrityManager) verify() (*IntegrityReport, error) {
+	now := time.Now()
+	report := &IntegrityReport{Checked: now, GracePeriod: m.AppState.Config.Janitor.GracePeriod}
+
+	// Storage is listed before the records are read, so an image created in
+	// between has its files listed too.
+	objects, err := m.AppState.Storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	albums, err := m.Repository.getAllAlbumRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := m.Repository.getAllImageRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	renditions, err := m.Repository.getAllRenditionRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	attachRenditions(images, renditions)
+
+	objectsByKey := make(map[string]*StorageObject)
+	for _, object := range objects {
+		if isLibraryKey(object.Key) {
+			objectsByKey[object.Key] = object
+		}
+	}
+
+	albumsByID := make(map[string]*AlbumRecord)
+	for _, album := range albums {
+		albumsByID[album.ID] = album
+	}
+
+	imagesByID := make(map[string]*ImageRecord)
+	expectedKeys := make(map[string]bool)
+	for _, image := range images {
+		imagesByID[image.ID] = image
+		for _, key := range getImageFileKeys(image) {
+			expectedKeys[key] = true
+		}
+
+		if now.Sub(image.Created) < report.GracePeriod {
+			continue
+		}
+
+		report.Issues = append(report.Issues, m.checkImageFiles(image, objectsByKey)...)
+	}
+
+	orphanIssues := make([]*IntegrityIssue, 0)
+	reattachedImageIDs := make(map[string]bool)
+	for _, object := range objectsByKey {
+		if expectedKeys[object.Key] || now.Sub(object.Modified) < report.GracePeriod {
+			continue
+		}
+
+		issue := m.getOrphanIssue(object, albumsByID, imagesByID)
+		if issue.Action == integrityActionReattach {
+			reattachedImageIDs[issue.ImageID] = true
+		}
+		orphanIssues = append(orphanIssues, issue)
+	}
+
+	// Re-attaching an original regenerates its derived images, so its old
+	// ones are left for that to overwrite rather than deleted.
+	for _, issue := range orphanIssues {
+		_, imageID, isOriginal := parseImageKey(issue.Key)
+		if !isOriginal && reattachedImageIDs[imageID] {
+			continue
+		}
+
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, album := range albums {
+		if album.CoverPhotoID == nil || *album.CoverPhotoID == "" {
+			continue
+		}
+
+		image, ok := imagesByID[*album.CoverPhotoID]
+		if ok && image.AlbumID == album.ID {
+			continue
+		}
+
+		report.Issues = append(report.Issues, &IntegrityIssue{
+			Kind:    integrityDanglingCover,
+			Action:  integrityActionResetCover,
+			AlbumID: album.ID,
+			ImageID: *album.CoverPhotoID,
+			Detail:  fmt.Sprintf("Cover of %q isn't an image in the album", album.Title),
+		})
+	}
+
+	staleTempIssues, err := m.getStaleTempIssues(now, report.GracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	report.Issues = append(report.Issues, staleTempIssues...)
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Kind != report.Issues[j].Kind {
+			return report.Issues[i].Kind < report.Issues[j].Kind
+		}
+		return report.Issues[i].Key < report.Issues[j].Key
+	})
+
+	report.Albums = len(albums)
+	report.Images = len(images)
+	report.Files = len(objectsByKey)
+
+	return report, nil
+}
+
+// checkImageFiles reports an image whose original is gone, which can only
+// be deleted, or whose derived images are gone, which can be regenerated.
+func (m *IntegrityManager) checkImageFiles(image *ImageRecord, objectsByKey map[string]*StorageObject) []*IntegrityIssue {
+	if _, ok := objectsByKey[image.Path]; !ok {
+		return []*IntegrityIssue{{
+			Kind:    integrityMissingOriginal,
+			Action:  integrityActionDelete,
+			Key:     image.Path,
+			AlbumID: image.AlbumID,
+			ImageID: image.ID,
+			Detail:  "The original is missing, so the image can't be recovered",
+		}}
+	}
+
+	// Derived images are still to come for an image that's being processed,
+	// and a failed one never got them.
+	if image.Status != imageStatusReady {
+		return nil
+	}
+
+	thumbnailKeys := []string{getThumbnailFilePath(image.Path)}
+	if m.AppState.RenditionOptions.WebP {
+		thumbnailKeys = append(thumbnailKeys, getWebPFilePath(thumbnailKeys[0]))
+	}
+
+	for _, key := range thumbnailKeys {
+		if _, ok := objectsByKey[key]; !ok {
+			return []*IntegrityIssue{{
+				Kind:    integrityMissingThumbnail,
+				Action:  integrityActionRegenerate,
+				Key:     key,
+				AlbumID: image.AlbumID,
+				ImageID: image.ID,
+				Detail:  "Can be rebuilt from the original",
+			}}
+		}
+	}
+
+	for _, rendition := range image.Renditions {
+		keys := []string{rendition.Path}
+		if rendition.WebPPath != nil {
+			keys = append(keys, *rendition.WebPPath)
+		}
+
+		for _, key := range keys {
+			if _, ok := objectsByKey[key]; !ok {
+				return []*IntegrityIssue{{
+					Kind:    integrityMissingRendition,
+					Action:  integrityActionRegenerate,
+					Key:     key,
+					AlbumID: image.AlbumID,
+					ImageID: image.ID,
+					Detail:  "Can be rebuilt from the original",
+				}}
+			}
+		}
+	}
+
+	return nil
+}
+
+// getOrphanIssue decides what to do with a file no record refers to. An
+// original in an album that still exists gets its record back; anything
+// else, such as derived images of deleted images or partial writes, is
+// deleted.
+func (m *IntegrityManager) getOrphanIssue(object *StorageObject, albumsByID map[string]*AlbumRecord, imagesByID map[string]*ImageRecord) *IntegrityIssue {
+	issue := &IntegrityIssue{
+		Kind:   integrityOrphanFile,
+		Action: integrityActionDelete,
+		Key:    object.Key,
+		Bytes:  object.Size,
+	}
+
+	albumID, imageID, isOriginal := parseImageKey(object.Key)
+	issue.AlbumID = albumID
+
+	_, albumExists := albumsByID[albumID]
+	_, imageExists := imagesByID[imageID]
+
+	switch {
+	case !isOriginal:
+		issue.Detail = "Derived or partially written file"
+	case imageExists:
+		issue.Detail = "Another file is recorded as this image's original"
+	case albumExists:
+		issue.Action = integrityActionReattach
+		issue.ImageID = imageID
+		issue.Detail = "Original without a record"
+	default:
+		issue.Detail = "Original from a deleted album"
+	}
+
+	return issue
+}
+
+func (m *IntegrityManager) getStaleTempIssues(now time.Time, gracePeriod time.Duration) ([]*IntegrityIssue, error) {
+	files, err := ioutil.ReadDir(m.getTempDirectoryPath())
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]*IntegrityIssue, 0)
+	for _, file := range files {
+		if file.IsDir() || now.Sub(file.ModTime()) < gracePeriod {
+			continue
+		}
+
+		issues = append(issues, &IntegrityIssue{
+			Kind:   integrityStaleTemp,
+			Action: integrityActionDelete,
+			Key:    file.Name(),
+			Bytes:  file.Size(),
+			Detail: "Upload abandoned " + file.ModTime().Format("2006-01-02 15:04"),
+		})
+	}
+
+	return issues, nil
+}
+
+// fix applies each issue's action, recording whether it worked on the issue.
+func (m *IntegrityManager) fix(report *IntegrityReport) {
+	regenerated := make(map[string]error)
+
+	for _, issue := range report.Issues {
+		var err error
+
+		switch issue.Kind {
+		case integrityOrphanFile:
+			if issue.Action == integrityActionReattach {
+				err = m.ImageManager.reattachImage(issue.AlbumID, issue.ImageID, issue.Key)
+			} else {
+				err = m.AppState.Storage.Delete(issue.Key)
+			}
+		case integrityMissingOriginal:
+			err = m.Repository.deleteImage(issue.ImageID)
+			if err == nil {
+				m.ImageManager.deleteImageFiles(issue.Key)
+			}
+		case integrityMissingThumbnail, integrityMissingRendition:
+			// One regeneration covers every derived image of the image.
+			previous, ok := regenerated[issue.ImageID]
+			if ok {
+				err = previous
+			} else {
+				err = m.ImageManager.regenerateDerivedImages(issue.ImageID, "repair")
+				regenerated[issue.ImageID] = err
+			}
+		case integrityDanglingCover:
+			err = m.Repository.resetCoverPhoto(issue.AlbumID)
+		case integrityStaleTemp:
+			err = os.Remove(filepath.Join(m.getTempDirectoryPath(), issue.Key))
+		}
+
+		if err != nil {
+			issue.Error = err.Error()
+			continue
+		}
+
+		issue.Fixed = true
+	}
+}
+
+func (m *IntegrityManager) getTempDirectoryPath() string {
+	return filepath.Join(m.AppState.imageDirectoryPath, "temp")
+}
+
+// getImageFileKeys lists every file that belongs to an image. Only current
+// files count, so leftovers such as the old display image show up as
+// orphans.
+func getImageFileKeys(image *ImageRecord) []string {
+	thumbnailKey := getThumbnailFilePath(image.Path)
+	keys := []string{image.Path, thumbnailKey, getWebPFilePath(thumbnailKey)}
+
+	for _, rendition := range image.Renditions {
+		keys = append(keys, rendition.Path)
+		if rendition.WebPPath != nil {
+			keys = append(keys, *rendition.WebPPath)
+		}
+	}
+
+	return keys
+}
+
+// parseImageKey splits "<albumID>/<imageID>.<ext>" keys. Derived images have
+// more than one dot after the image ID.
+func parseImageKey(key string) (albumID string, imageID string, isOriginal bool) {
+	albumID, fileName := path.Split(key)
+	albumID = strings.TrimSuffix(albumID, "/")
+
+	parts := strings.Split(fileName, ".")
+	isOriginal = len(parts) == 2 && parts[0] != "" && albumID != "" && !strings.Contains(albumID, "/")
+
+	return albumID, parts[0], isOriginal
+}
+
+// isLibraryKey leaves out storage keys that aren't library files, such as
+// the temp and quarantine directories of the filesystem backend and the
+// readiness probes.
+func isLibraryKey(key string) bool {
+	return !strings.HasPrefix(key, "temp/") && !strings.HasPrefix(key, "quarantine/") && !strings.HasPrefix(key, readinessProbePrefix)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	janitorRemovedTemp = "removed_temp"
+	janitorQuarantined = "quarantined"
+	janitorPurged      = "purged"
+	janitorExpired     = "expired_upload"
+)
+
+// JanitorResult counts what one janitor run cleaned up.
+type JanitorResult struct {
+	Files map[string]int
+	Bytes map[string]int64
+}
+
+func (r *JanitorResult) add(action string, bytes int64) {
+	r.Files[action]++
+	r.Bytes[action] += bytes
+}
+
+// Janitor cleans up after uploads and deletes that didn't finish. Temp files
+// and expired resumable uploads are removed, while files in storage that no
+// image refers to are moved to the quarantine directory in case they're
+// still wanted. A quarantined original can be restored by copying it back to
+// its album folder and running picfolio verify --fix to re-attach it.
+// Expired server-side sessions are deleted as well.
+type Janitor struct {
+	AppState  *AppState
+	Integrity *IntegrityManager
+	Tus       *TusManager
+	Sessions  *SessionManager
+	Config    *JanitorConfig
+}
+
+func newJanitor(a *AppState) *Janitor {
+	return &Janitor{
+		AppState:  a,
+		Integrity: a.IntegrityManager,
+		Tus:       a.TusManager,
+		Sessions:  a.SessionManager,
+		Config:    &a.Config.Janitor,
+	}
+}
+
+// run cleans up once at startup and then every Interval until ctx is
+// cancelled.
+func (j *Janitor) run(ctx context.Context) {
+	j.sweepAndReport(ctx)
+
+	if j.Config.Interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.Config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.sweepAndReport(ctx)
+		}
+	}
+}
+
+func (j *Janitor) sweepAndReport(ctx context.Context) {
+	start := time.Now()
+
+	result, err := j.sweep(ctx)
+	j.AppState.Metrics.observeJanitor(result, err)
+	if err != nil {
+		slog.Error("Janitor run failed", "error", err)
+		return
+	}
+
+	slog.Info("Janitor finished",
+		"temp_files", result.Files[janitorRemovedTemp],
+		"temp_bytes", result.Bytes[janitorRemovedTemp],
+		"quarantined_files", result.Files[janitorQuarantined],
+		"quarantined_bytes", result.Bytes[janitorQuarantined],
+		"purged_files", result.Files[janitorPurged],
+		"purged_bytes", result.Bytes[janitorPurged],
+		"expired_uploads", result.Files[janitorExpired],
+		"expired_upload_bytes", result.Bytes[janitorExpired],
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// sweep finds abandoned files with the integrity checker, so the janitor
+// and picfolio verify agree on what's abandoned. It stops between files once
+// ctx is cancelled.
+func (j *Janitor) sweep(ctx context.Context) (*JanitorResult, error) {
+	result := &JanitorResult{Files: make(map[string]int), Bytes: make(map[string]int64)}
+
+	report, err := j.Integrity.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	runDirectoryPath := filepath.Join(j.getQuarantineDirectoryPath(), report.Checked.UTC().Format("20060102-150405"))
+
+	for _, issue := range report.Issues {
+		if ctx.Err() != nil {
+			return result, nil
+		}
+
+		switch issue.Kind {
+		case integrityStaleTemp:
+			err = os.Remove(filepath.Join(j.Integrity.getTempDirectoryPath(), issue.Key))
+			if err != nil {
+				slog.Warn("Unable to remove temp file", "file", issue.Key, "error", err)
+				continue
+			}
+
+			result.add(janitorRemovedTemp, issue.Bytes)
+		case integrityOrphanFile:
+			objects, err := j.getQuarantineObjects(issue.Key)
+			if err != nil {
+				slog.Warn("Unable to list files to quarantine", "key", issue.Key, "error", err)
+				continue
+			}
+
+			for _, object := range objects {
+				err = j.quarantine(object.Key, runDirectoryPath)
+				if err != nil {
+					slog.Warn("Unable to quarantine file", "key", object.Key, "error", err)
+					continue
+				}
+
+				slog.Info("Quarantined file without an image", "key", object.Key, "bytes", object.Size)
+				result.add(janitorQuarantined, object.Size)
+			}
+		}
+	}
+
+	err = j.purgeQuarantine(report.Checked, result)
+	if err != nil {
+		return nil, err
+	}
+
+	expiredUploads, expiredBytes, err := j.Tus.expireUploads(report.Checked)
+	if err != nil {
+		return nil, err
+	}
+	result.Files[janitorExpired] += expiredUploads
+	result.Bytes[janitorExpired] += expiredBytes
+
+	err = j.Sessions.deleteExpiredSessions(report.Checked.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// getQuarantineObjects returns the orphan at key along with, for an
+// original, the derived images the integrity checker leaves out of its
+// report because re-attaching would rebuild them.
+func (j *Janitor) getQuarantineObjects(key string) ([]*StorageObject, error) {
+	_, _, isOriginal := parseImageKey(key)
+	if !isOriginal {
+		object, err := j.AppState.Storage.Stat(key)
+		if err != nil || object == nil {
+			return nil, err
+		}
+		return []*StorageObject{object}, nil
+	}
+
+	return j.AppState.Storage.List(getKeyWithoutExtension(key) + ".")
+}
+
+// quarantine copies a storage object below runDirectoryPath, keeping its key
+// as the relative path, then removes it from storage.
+func (j *Janitor) quarantine(key string, runDirectoryPath string) error {
+	filePath := filepath.Join(runDirectoryPath, filepath.FromSlash(cleanStorageKey(key)))
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = getStorageFile(j.AppState.Storage, key, filePath)
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	return j.AppState.Storage.Delete(key)
+}
+
+// purgeQuarantine deletes quarantine runs older than the retention.
+func (j *Janitor) purgeQuarantine(now time.Time, result *JanitorResult) error {
+	if j.Config.QuarantineRetention == 0 {
+		return nil
+	}
+
+	runs, err := ioutil.ReadDir(j.getQuarantineDirectoryPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, run := range runs {
+		if !run.IsDir() || now.Sub(run.ModTime()) < j.Config.QuarantineRetention {
+			continue
+		}
+
+		runDirectoryPath := filepath.Join(j.getQuarantineDirectoryPath(), run.Name())
+
+		var files int
+		var bytes int64
+		filepath.Walk(runDirectoryPath, func(filePath string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files++
+				bytes += info.Size()
+			}
+			return nil
+		})
+
+		err = os.RemoveAll(runDirectoryPath)
+		if err != nil {
+			slog.Warn("Unable to purge quarantine", "directory", run.Name(), "error", err)
+			continue
+		}
+
+		result.Files[janitorPurged] += files
+		result.Bytes[janitorPurged] += bytes
+	}
+
+	return nil
+}
+
+func (j *Janitor) getQuarantineDirectoryPath() string {
+	return filepath.Join(j.AppState.imageDirectoryPath, "quarantine")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	jobProcessImage    = "process"
+	jobRotateImage     = "rotate"
+	jobRegenerateImage = "regenerate"
+)
+
+const (
+	jobStatusQueued  = "queued"
+	jobStatusRunning = "running"
+	jobStatusDone    = "done"
+	jobStatusFailed  = "failed"
+)
+
+const (
+	imageStatusProcessing = "processing"
+	imageStatusReady      = "ready"
+	imageStatusFailed     = "failed"
+)
+
+var errUnknownJobKind = errors.New("Unknown job kind")
+
+// jobPollInterval is how often idle workers look for jobs that became due,
+// such as retries. New jobs wake a worker straight away.
+const jobPollInterval = 5 * time.Second
+
+// jobPruneInterval is how often finished jobs past their retention are
+// deleted.
+const jobPruneInterval = time.Hour
+
+// JobQueue processes images in the background with a pool of workers. Jobs
+// are kept in the database so they survive a restart, and are retried with
+// a growing delay when they fail.
+type JobQueue struct {
+	AppState     *AppState
+	Repository   *Repository
+	ImageManager *ImageManager
+	Config       *JobsConfig
+
+	claimLock sync.Mutex
+	wake      chan struct{}
+}
+
+func newJobQueue(a *AppState) *JobQueue {
+	return &JobQueue{
+		AppState:     a,
+		Repository:   a.Repository,
+		ImageManager: a.ImageManager,
+		Config:       &a.Config.Jobs,
+		wake:         make(chan struct{}, a.Config.Jobs.Workers),
+	}
+}
+
+// enqueue adds a job for an image and wakes a worker for it.
+func (q *JobQueue) enqueue(kind string, imageID string) error {
+	created, err := q.Repository.createJobRecord(q.AppState.generateID(), kind, imageID)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		q.notify()
+	}
+
+	return nil
+}
+
+// notify wakes a worker for a job added to the database directly.
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// getLatestJobsByAlbumID returns the most recent job of each image in the
+// album.
+func (q *JobQueue) getLatestJobsByAlbumID(albumID string) ([]*JobRecord, error) {
+	return q.Repository.getLatestJobRecordsByAlbumID(albumID)
+}
+
+// start recovers jobs interrupted by the last shutdown, then starts the
+// workers and the pruning of old jobs as background tasks.
+func (q *JobQueue) start() {
+	requeued, err := q.Repository.requeueRunningJobRecords()
+	if err != nil {
+		fatal("Unable to requeue interrupted jobs", err)
+	}
+	if requeued > 0 {
+		slog.Info("Requeued interrupted jobs", "jobs", requeued)
+	}
+
+	imageIDs, err := q.Repository.getUnqueuedProcessingImageIDs()
+	if err != nil {
+		fatal("Unable to find images waiting to be processed", err)
+	}
+	for _, imageID := range imageIDs {
+		err = q.enqueue(jobProcessImage, imageID)
+		if err != nil {
+			fatal("Unable to queue image processing", err)
+		}
+	}
+
+	for i := 0; i < q.Config.Workers; i++ {
+		q.AppState.Lifecycle.run(q.work)
+	}
+	q.AppState.Lifecycle.run(q.prune)
+}
+
+// work runs jobs until ctx is cancelled. A job that's running when that
+// happens is finished first.
+func (q *JobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := q.claim()
+		if err != nil {
+			slog.Error("Unable to claim job", "error", err)
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		q.runJob(job)
+	}
+}
+
+func (q *JobQueue) claim() (*JobRecord, error) {
+	q.claimLock.Lock()
+	defer q.claimLock.Unlock()
+
+	return q.Repository.claimJobRecord(time.Now())
+}
+
+func (q *JobQueue) runJob(job *JobRecord) {
+	logger := slog.With("job_id", job.ID, "kind", job.Kind, "image_id", job.ImageID, "attempt", job.Attempts)
+	start := time.Now()
+
+	var err error
+	switch job.Kind {
+	case jobProcessImage:
+		err = q.ImageManager.processImage(job.ImageID)
+	case jobRotateImage:
+		err = q.ImageManager.regenerateDerivedImages(job.ImageID, "rotate")
+	case jobRegenerateImage:
+		err = q.ImageManager.regenerateDerivedImages(job.ImageID, "backfill")
+	default:
+		logger.Error("Unknown job kind")
+		err = errUnknownJobKind
+	}
+
+	if err == nil {
+		q.AppState.Metrics.JobRuns.WithLabelValues(job.Kind, "success").Inc()
+		err = q.Repository.updateJobRecord(job.ID, jobStatusDone, nil, job.RunAfter)
+		if err != nil {
+			logger.Error("Unable to record finished job", "error", err)
+			return
+		}
+
+		logger.Info("Job finished", "duration_ms", time.Since(start).Milliseconds())
+		return
+	}
+
+	message := err.Error()
+
+	// Nothing changes for an image that's gone or isn't an image, so those
+	// aren't retried.
+	_, isUploadError := err.(*UploadError)
+	if job.Attempts < q.Config.MaxAttempts && err != errImageNotFound && err != errUnknownJobKind && !isUploadError {
+		q.AppState.Metrics.JobRuns.WithLabelValues(job.Kind, "retry").Inc()
+		runAfter := time.Now().Add(q.Config.RetryDelay << uint(job.Attempts-1))
+
+		err = q.Repository.updateJobRecord(job.ID, jobStatusQueued, &message, runAfter)
+		if err != nil {
+			logger.Error("Unable to requeue job", "error", err)
+			return
+		}
+
+		logger.Warn("Job failed, retrying", "error", message, "retry_at", runAfter)
+		return
+	}
+
+	q.AppState.Metrics.JobRuns.WithLabelValues(job.Kind, "failed").Inc()
+	err = q.Repository.updateJobRecord(job.ID, jobStatusFailed, &message, job.RunAfter)
+	if err != nil {
+		logger.Error("Unable to record failed job", "error", err)
+		return
+	}
+
+	// An upload that never got processed can't be shown. Images that were
+	// already showing keep their previous derived images.
+	if job.Kind == jobProcessImage {
+		err = q.Repository.setImageStatus(job.ImageID, imageStatusFailed)
+		if err != nil {
+			logger.Error("Unable to mark image as failed", "error", err)
+		}
+
+		image, err := q.Repository.getImageRecord(job.ImageID)
+		if err == nil && image != nil {
+			q.ImageManager.publishImageEvent(uploadEventFailed, image, message)
+		}
+	}
+
+	logger.Error("Job failed", "error", message)
+}
+
+// prune deletes finished jobs once they're older than the retention.
+func (q *JobQueue) prune(ctx context.Context) {
+	ticker := time.NewTicker(jobPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := q.Repository.deleteFinishedJobRecords(time.Now().Add(-q.Config.Retention))
+		if err != nil {
+			slog.Error("Unable to prune jobs", "error", err)
+		} else if deleted > 0 {
+			slog.Info("Pruned finished jobs", "jobs", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Lifecycle tracks background work started by the app so shutdown can tell
+// it to stop and wait for it to finish.
+type Lifecycle struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	tasks    sync.WaitGroup
+	stopping int32
+}
+
+func newLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// run starts task in the background. Its context is cancelled when shutdown
+// begins, and the task should return soon after.
+func (l *Lifecycle) run(task func(ctx context.Context)) {
+	l.tasks.Add(1)
+
+	go func() {
+		defer l.tasks.Done()
+		task(l.ctx)
+	}()
+}
+
+// beginStopping marks the app as shutting down so readiness checks fail
+// while requests drain.
+func (l *Lifecycle) beginStopping() {
+	atomic.StoreInt32(&l.stopping, 1)
+}
+
+func (l *Lifecycle) isStopping() bool {
+	return atomic.LoadInt32(&l.stopping) == 1
+}
+
+// stop cancels background tasks and waits for them until ctx is done.
+func (l *Lifecycle) stop(ctx context.Context) error {
+	l.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		l.tasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// The deadline may have passed while the servers drained, after the
+	// tasks had already finished.
+	select {
+	case <-done:
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
+
+func newHTTPServer(address string, handler http.Handler, config *ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           clientIPMiddleware(parseTrustedProxies(config.TrustedProxies), handler),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// listen binds the server's address and serves in the background. A server
+// that stops for any reason other than shutdown takes the app down with it.
+func (a *AppState) listen(server *http.Server) {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal("Unable to listen", err)
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			a.exitCallback <- err
+		}
+	}()
+}
+
+// shutdown stops accepting requests, waits for in-flight requests such as
+// uploads and for background image processing, then closes the database.
+// Anything still running when the shutdown timeout passes is abandoned.
+func (a *AppState) shutdown(servers ...*http.Server) {
+	a.Lifecycle.beginStopping()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.Config.Server.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			err := server.Shutdown(ctx)
+			if err != nil {
+				slog.Warn("Server didn't finish its requests", "address", server.Addr, "error", err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	err := a.Lifecycle.stop(ctx)
+	if err != nil {
+		slog.Warn("Background tasks didn't finish", "error", err)
+	}
+
+	a.removeTempFiles()
+
+	err = a.Repository.close()
+	if err != nil {
+		slog.Error("Unable to close the database", "error", err)
+	}
+
+	slog.Info("Shutdown complete")
+}
+
+// removeTempFiles deletes uploads left in the temp directory. It's only
+// called when no upload can be in progress, so anything there was abandoned
+// by a request that didn't finish.
+func (a *AppState) removeTempFiles() {
+	tempDirectoryPath := filepath.Join(a.imageDirectoryPath, "temp")
+
+	files, err := ioutil.ReadDir(tempDirectoryPath)
+	if err != nil {
+		slog.Error("Unable to read temp directory", "error", err)
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(tempDirectoryPath, file.Name()))
+		if err != nil {
+			slog.Warn("Unable to remove temp file", "file", file.Name(), "error", err)
+			continue
+		}
+
+		slog.Info("Removed abandoned temp file", "file", file.Name(), "modified", file.ModTime(), "bytes", file.Size())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+const (
+	requestIDContextKey contextKey = "requestId"
+	loggerContextKey    contextKey = "logger"
+)
+
+// quietPaths are polled by monitoring, so their access logs are only kept at
+// debug level.
+var quietPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// validRequestID limits which incoming request IDs are trusted, so a proxy's
+// ID can be kept without letting clients write arbitrary text into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// setupLogging sends everything, including the standard log package, to a
+// structured handler at the configured level.
+func setupLogging(config *LoggingConfig) {
+	level, _ := parseLogLevel(config.Level)
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if config.Format == logFormatText {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// parseLogLevel accepts debug, info, warn or error.
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(value))
+	return level, err
+}
+
+// fatal logs err and exits. It's for startup problems the app can't run
+// without.
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+// loggingMiddleware gives every request an ID, returned in X-Request-ID and
+// attached to everything logged while handling it, and writes an access log
+// line once the response is done.
+func loggingMiddleware(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = generateRequestID()
+		}
+
+		logger := slog.Default().With("request_id", requestID)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		ctx = context.WithValue(ctx, loggerContextKey, logger)
+		r = r.WithContext(ctx)
+
+		w.Header().Set(requestIDHeader, requestID)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if quietPaths[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+
+		logger.Log(r.Context(), level, "Request",
+			"server", server,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"ip", getClientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
+// getLogger returns the logger for a request, tagged with its request ID.
+func getLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+func getRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// serverError logs err for the request and tells the client something went
+// wrong without the details, which can include SQL or file paths. The
+// request ID lets someone find the logged error.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	getLogger(r).Error("Request failed", "error", err, "path", r.URL.Path)
+	http.Error(w, getServerErrorMessage(r), http.StatusInternalServerError)
+}
+
+func getServerErrorMessage(r *http.Request) string {
+	message := "Something went wrong on our end"
+	if requestID := getRequestID(r); requestID != "" {
+		message += " (request " + requestID + ")"
+	}
+
+	return message
+}
+
+func generateRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
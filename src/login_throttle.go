@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// loginFreeAttempts failures are allowed before backoff starts.
+	loginFreeAttempts = 3
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 5 * time.Minute
+
+	// Usernames lock out sooner than IP addresses since several people can
+	// share an office address.
+	loginUsernameLockoutThreshold = 10
+	loginIPLockoutThreshold       = 30
+
+	loginFailureWindow    = 15 * time.Minute
+	loginLockoutDuration  = 15 * time.Minute
+	loginAttemptRetention = 90 * 24 * time.Hour
+)
+
+const (
+	loginReasonInvalidCredentials = "invalid_credentials"
+	loginReasonInvalidCode        = "invalid_code"
+	loginReasonThrottled          = "throttled"
+	loginReasonOIDCRefused        = "oidc_refused"
+)
+
+// LoginThrottle slows down repeated failed sign ins from one IP address or
+// against one username, and writes every attempt to the loginAttempts audit
+// table.
+type LoginThrottle struct {
+	Repository *Repository
+}
+
+type LoginThrottleStatus struct {
+	RetryAfter time.Duration
+	LockedOut  bool
+}
+
+func newLoginThrottle(repository *Repository) *LoginThrottle {
+	err := repository.deleteLoginAttemptRecordsBefore(time.Now().UTC().Add(-loginAttemptRetention))
+	if err != nil {
+		slog.Error("Unable to remove old login attempts", "error", err)
+	}
+
+	return &LoginThrottle{
+		Repository: repository,
+	}
+}
+
+// check reports how long the username and IP address must wait before
+// their next attempt. A zero RetryAfter means they may try now.
+func (t *LoginThrottle) check(username string, ipAddress string) (*LoginThrottleStatus, error) {
+	now := time.Now().UTC()
+	status := &LoginThrottleStatus{}
+
+	// A successful sign in clears its username's failures, but an IP
+	// address's only expire, so signing in to one account from it doesn't
+	// reset guessing at others.
+	keys := []struct {
+		column           string
+		value            string
+		threshold        int
+		sinceLastSuccess bool
+	}{
+		{"username", normalizeLoginUsername(username), loginUsernameLockoutThreshold, true},
+		{"ipAddress", ipAddress, loginIPLockoutThreshold, false},
+	}
+
+	for _, key := range keys {
+		if key.value == "" {
+			continue
+		}
+
+		// Throttled attempts are audited but don't extend the wait.
+		failures, err := t.Repository.getLoginFailureTimes(key.column, key.value, loginReasonThrottled, now.Add(-loginFailureWindow), key.sinceLastSuccess, key.threshold)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(failures) < loginFreeAttempts {
+			continue
+		}
+
+		lockedOut := len(failures) >= key.threshold
+		retryAt := failures[0].Add(getLoginBackoff(len(failures)))
+		if lockedOut {
+			retryAt = failures[0].Add(loginLockoutDuration)
+		}
+
+		if wait := retryAt.Sub(now); wait > status.RetryAfter {
+			status.RetryAfter = wait
+			status.LockedOut = lockedOut
+		}
+	}
+
+	return status, nil
+}
+
+func (t *LoginThrottle) record(username string, ipAddress string, userAgent string, success bool, reason string) error {
+	record := &LoginAttemptRecord{
+		Username:  normalizeLoginUsername(username),
+		IPAddress: ipAddress,
+		Success:   success,
+		UserAgent: userAgent,
+		Created:   time.Now().UTC(),
+	}
+
+	if reason != "" {
+		record.Reason = &reason
+	}
+
+	if !success {
+		slog.Warn("Failed sign in", "username", record.Username, "ip", ipAddress, "reason", reason)
+	}
+
+	return t.Repository.createLoginAttemptRecord(record)
+}
+
+// getLoginBackoff doubles the wait for every failure past the free attempts.
+func getLoginBackoff(failures int) time.Duration {
+	delay := loginBaseDelay
+	for i := loginFreeAttempts; i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+
+	return delay
+}
+
+func normalizeLoginUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Message explains the wait on the login page.
+func (s *LoginThrottleStatus) Message() string {
+	if s.LockedOut {
+		return fmt.Sprintf("Too many failed sign in attempts. Sign in is locked for %s.", formatRetryAfter(s.RetryAfter))
+	}
+
+	return fmt.Sprintf("Too many failed sign in attempts. Wait %s before trying again.", formatRetryAfter(s.RetryAfter))
+}
+
+func formatRetryAfter(d time.Duration) string {
+	if d > time.Minute {
+		minutes := int((d + time.Minute - 1) / time.Minute)
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds == 1 {
+		return "1 second"
+	}
+
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -1,15 +1,68 @@
 package main
 
+import (
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 func main() {
-	appState := newAppState()
+	config, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	setupLogging(&config.Logging)
+
+	appState := newAppState(config)
 
 	appState.initRepository()
 
+	if runCommand(appState, args) {
+		return
+	}
+
+	// Nothing is in progress yet, so anything in temp was left by a previous
+	// run that didn't shut down cleanly.
+	appState.removeTempFiles()
+
+	appState.JobQueue.start()
+	appState.Lifecycle.run(appState.ImageManager.generateMissingDerivedImages)
+	appState.Lifecycle.run(appState.Janitor.run)
+
 	adminServer := newAdminServer(appState)
 	publicServer := newPublicServer(appState)
 
 	adminServer.startListeningAdmin()
 	publicServer.startListeningPublic()
+	metricsServer := newMetricsServer(appState)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+
+		// A second signal skips waiting for in-flight work.
+		go func() {
+			<-signals
+			slog.Warn("Received a second signal, exiting immediately")
+			os.Exit(1)
+		}()
+	case err := <-appState.exitCallback:
+		slog.Error("Server stopped", "error", err)
+		exitCode = 1
+	}
+
+	appState.shutdown(adminServer.Server, publicServer.Server, metricsServer)
 
-	<-appState.exitCallback
+	os.Exit(exitCode)
 }
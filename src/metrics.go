@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "picfolio"
+
+// Metrics holds the Prometheus collectors served on /metrics.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	RequestsTotal      *prometheus.CounterVec
+	RequestDuration    *prometheus.HistogramVec
+	UploadsTotal       *prometheus.CounterVec
+	UploadBytesTotal   prometheus.Counter
+	ProcessingDuration *prometheus.HistogramVec
+	ThumbnailFailures  *prometheus.CounterVec
+	JanitorRuns        *prometheus.CounterVec
+	JanitorFiles       *prometheus.CounterVec
+	JanitorBytes       *prometheus.CounterVec
+	JanitorLastSuccess prometheus.Gauge
+	JobRuns            *prometheus.CounterVec
+}
+
+func newMetrics(repository *Repository) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by server, route, method and status code.",
+		}, []string{"server", "route", "method", "code"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by server, route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"server", "route", "method"}),
+		UploadsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "uploads_total",
+			Help:      "Uploaded files by result.",
+		}, []string{"result"}),
+		UploadBytesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_bytes_total",
+			Help:      "Bytes of uploaded files that were accepted.",
+		}),
+		ProcessingDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "image_processing_duration_seconds",
+			Help:      "Time spent generating derived images by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"operation"}),
+		ThumbnailFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "thumbnail_failures_total",
+			Help:      "Failures generating thumbnails and renditions by operation.",
+		}, []string{"operation"}),
+		JanitorRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_runs_total",
+			Help:      "Janitor runs by result.",
+		}, []string{"result"}),
+		JanitorFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_files_total",
+			Help:      "Files the janitor removed from temp, quarantined, purged from quarantine or expired as abandoned resumable uploads.",
+		}, []string{"action"}),
+		JanitorBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_bytes_total",
+			Help:      "Bytes the janitor removed from temp, quarantined, purged from quarantine or expired as abandoned resumable uploads.",
+		}, []string{"action"}),
+		JanitorLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_last_success_timestamp_seconds",
+			Help:      "When the janitor last finished without an error.",
+		}),
+		JobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_runs_total",
+			Help:      "Background job attempts by kind and result.",
+		}, []string{"kind", "result"}),
+	}
+
+	// Start known series at zero so rates work before the first event.
+	for _, operation := range []string{"upload", "rotate", "backfill", "repair"} {
+		m.ThumbnailFailures.WithLabelValues(operation)
+	}
+	for _, result := range []string{"accepted", "rejected", "failed"} {
+		m.UploadsTotal.WithLabelValues(result)
+	}
+	for _, result := range []string{"success", "failed"} {
+		m.JanitorRuns.WithLabelValues(result)
+	}
+	for _, action := range []string{janitorRemovedTemp, janitorQuarantined, janitorPurged, janitorExpired} {
+		m.JanitorFiles.WithLabelValues(action)
+		m.JanitorBytes.WithLabelValues(action)
+	}
+	for _, kind := range []string{jobProcessImage, jobRotateImage, jobRegenerateImage} {
+		for _, result := range []string{"success", "retry", "failed"} {
+			m.JobRuns.WithLabelValues(kind, result)
+		}
+	}
+
+	m.Registry.MustRegister(
+		m.RequestsTotal,
+		m.RequestDuration,
+		m.UploadsTotal,
+		m.UploadBytesTotal,
+		m.ProcessingDuration,
+		m.ThumbnailFailures,
+		m.JanitorRuns,
+		m.JanitorFiles,
+		m.JanitorBytes,
+		m.JanitorLastSuccess,
+		m.JobRuns,
+		newLibraryCollector(repository),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observeProcessing records how long an image operation took since start,
+// counting a failure when err is set.
+func (m *Metrics) observeProcessing(operation string, start time.Time, err error) {
+	m.ProcessingDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.ThumbnailFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+func (m *Metrics) observeJanitor(result *JanitorResult, err error) {
+	if err != nil {
+		m.JanitorRuns.WithLabelValues("failed").Inc()
+		return
+	}
+
+	m.JanitorRuns.WithLabelValues("success").Inc()
+	m.JanitorLastSuccess.SetToCurrentTime()
+
+	for action, files := range result.Files {
+		m.JanitorFiles.WithLabelValues(action).Add(float64(files))
+		m.JanitorBytes.WithLabelValues(action).Add(float64(result.Bytes[action]))
+	}
+}
+
+func (m *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// middleware counts and times requests by their route template, so
+// /album/{albumID} is one series rather than one per album.
+func (m *Metrics) middleware(server string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return m.instrument(server, next, func(r *http.Request) string {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					return template
+				}
+			}
+			return "unknown"
+		})
+	}
+}
+
+// instrument counts and times requests to next under the route getRoute
+// names. It also covers handlers the router's middleware doesn't reach,
+// such as the not found handler.
+func (m *Metrics) instrument(server string, next http.Handler, getRoute func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		route := getRoute(r)
+		m.RequestsTotal.WithLabelValues(server, route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		m.RequestDuration.WithLabelValues(server, route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func addHealthRoutes(a *AppState, r *mux.Router) {
+	r.Handle("/healthz", healthHandler(a, false)).Methods("GET")
+	r.Handle("/readyz", healthHandler(a, true)).Methods("GET")
+	r.Handle("/metrics", a.Metrics.handler()).Methods("GET")
+}
+
+// newMetricsServer serves health checks and metrics on their own address,
+// usually one that only the monitoring network can reach.
+func newMetricsServer(a *AppState) *http.Server {
+	if a.Config.Metrics.Address == "" {
+		return nil
+	}
+
+	router := mux.NewRouter()
+	addHealthRoutes(a, router)
+
+	server := newHTTPServer(a.Config.Metrics.Address, loggingMiddleware("metrics", router), &a.Config.Server)
+	a.listen(server)
+
+	slog.Info("Metrics server started", "address", a.Config.Metrics.Address)
+
+	return server
+}
+
+// statusRecorder remembers the status and size of a response for metrics
+// and access logs.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush and Hijack pass through so streaming responses keep working.
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// libraryCollector reads library totals from the database when scraped.
+type libraryCollector struct {
+	Repository *Repository
+	albums     *prometheus.Desc
+	images     *prometheus.Desc
+	bytes      *prometheus.Desc
+	jobs       *prometheus.Desc
+}
+
+func newLibraryCollector(repository *Repository) *libraryCollector {
+	return &libraryCollector{
+		Repository: repository,
+		albums:     prometheus.NewDesc(metricsNamespace+"_albums", "Albums in the library.", nil, nil),
+		images:     prometheus.NewDesc(metricsNamespace+"_images", "Images in the library.", nil, nil),
+		bytes:      prometheus.NewDesc(metricsNamespace+"_stored_bytes", "Bytes stored by kind of file.", []string{"kind"}, nil),
+		jobs:       prometheus.NewDesc(metricsNamespace+"_jobs", "Background jobs by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *libraryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.albums
+	ch <- c.images
+	ch <- c.bytes
+	ch <- c.jobs
+}
+
+func (c *libraryCollector) Collect(ch chan<- prometheus.Metric) {
+	totals, err := c.Repository.getLibraryTotals()
+	if err != nil {
+		slog.Error("Unable to read library totals", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.albums, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.albums, prometheus.GaugeValue, float64(totals.Albums))
+	ch <- prometheus.MustNewConstMetric(c.images, prometheus.GaugeValue, float64(totals.Images))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(totals.OriginalBytes), "original")
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(totals.RenditionBytes), "rendition")
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(totals.WebPBytes), "webp")
+
+	jobs, err := c.Repository.countJobRecordsByStatus()
+	if err != nil {
+		slog.Error("Unable to count jobs", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.jobs, err)
+		return
+	}
+
+	for _, status := range []string{jobStatusQueued, jobStatusRunning, jobStatusDone, jobStatusFailed} {
+		ch <- prometheus.MustNewConstMetric(c.jobs, prometheus.GaugeValue, float64(jobs[status]), status)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const migrationsTableSQL = `
+CREATE TABLE IF NOT EXISTS schemaMigrations (
+	version INT NOT NULL PRIMARY KEY,
+	description TEXT,
+	applied TIMESTAMP
+);
+`
+
+// Migration is a single, ordered schema change. SQL runs first, followed by
+// Apply when set, both inside the same transaction.
+type Migration struct {
+	Version     int
+	Description string
+	SQL         string
+	Apply       func(tx *sql.Tx) error
+}
+
+// migrations must be kept in ascending, gap-free version order. Released
+// migrations are never edited; add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create images and albums tables",
+		SQL:         initSQL,
+	},
+	{
+		Version:     2,
+		Description: "Store image paths as storage keys",
+		SQL:         "update images set path = albumId || '/' || id || '.' || fileType;",
+	},
+	{
+		Version:     3,
+		Description: "Add EXIF, IPTC and XMP metadata to images",
+		SQL:         imageMetadataSQL,
+	},
+	{
+		Version:     4,
+		Description: "Track image rotation separately from the original file",
+		SQL:         imageRotationSQL,
+	},
+	{
+		Version:     5,
+		Description: "Track responsive image renditions",
+		SQL:         renditionsSQL,
+	},
+	{
+		Version:     6,
+		Description: "Track WebP renditions",
+		SQL:         renditionsWebPSQL,
+	},
+	{
+		Version:     7,
+		Description: "Add user accounts and album permissions",
+		SQL:         usersSQL,
+	},
+	{
+		Version:     8,
+		Description: "Add personal API tokens",
+		SQL:         apiTokensSQL,
+	},
+	{
+		Version:     9,
+		Description: "Persist session keys and server-side sessions",
+		SQL:         sessionsSQL,
+	},
+	{
+		Version:     10,
+		Description: "Audit login attempts",
+		SQL:         loginAttemptsSQL,
+	},
+	{
+		Version:     11,
+		Description: "Add TOTP two-factor authentication",
+		SQL:         twoFactorSQL,
+	},
+	{
+		Version:     12,
+		Description: "Link users to OpenID Connect identities",
+		SQL:         oidcSQL,
+	},
+	{
+		Version:     13,
+		Description: "Record the SHA-256 of each original",
+		SQL:         imageSHA256SQL,
+	},
+	{
+		Version:     14,
+		Description: "Process images in a background job queue",
+		SQL:         jobsSQL,
+	},
+}
+
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func (r *Repository) migrate() error {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("Migration %q has version %d, expected %d", m.Description, m.Version, i+1)
+		}
+	}
+
+	_, err := r.Database.Exec(migrationsTableSQL)
+	if err != nil {
+		return err
+	}
+
+	currentVersion, err := r.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latestVersion := latestSchemaVersion()
+	if currentVersion > latestVersion {
+		return fmt.Errorf("Database schema version %d is newer than the latest version %d supported by this build", currentVersion, latestVersion)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= currentVersion {
+			continue
+		}
+
+		err = r.applyMigration(m)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Applied schema migration", "version", m.Version, "description", m.Description)
+	}
+
+	return nil
+}
+
+func (r *Repository) getSchemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := r.Database.QueryRow("select max(version) from schemaMigrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+func (r *Repository) applyMigration(m Migration) error {
+	tx, err := r.Database.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = runMigration(tx, m)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Description, err)
+	}
+
+	return tx.Commit()
+}
+
+func runMigration(tx *sql.Tx, m Migration) error {
+	if m.SQL != "" {
+		_, err := tx.Exec(m.SQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Apply != nil {
+		err := m.Apply(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec("insert into schemaMigrations (version, description, applied) values (?,?,?)", m.Version, m.Description, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcRequestTimeout = 10 * time.Second
+
+var errOIDCNoRole = errors.New("Your account isn't allowed to use Picfolio")
+var errOIDCUsernameTaken = errors.New("Your username is already used by another Picfolio account")
+
+// OIDCOptions configure sign in through an OpenID Connect provider. Roles
+// come from the values of RoleClaim, usually the user's groups, looked up in
+// RoleMap. Users without a mapped value get DefaultRole, or are turned away
+// when it's empty.
+type OIDCOptions struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	UsernameClaim string
+	RoleClaim     string
+	RoleMap       map[string]Role
+	DefaultRole   Role
+	// Only disables password sign in.
+	Only bool
+}
+
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Role     Role
+}
+
+type OIDCManager struct {
+	AppState   *AppState
+	Repository *Repository
+	Options    *OIDCOptions
+
+	mutex    sync.Mutex
+	provider *oidc.Provider
+}
+
+func newOIDCManager(a *AppState, options *OIDCOptions) *OIDCManager {
+	return &OIDCManager{
+		AppState:   a,
+		Repository: a.Repository,
+		Options:    options,
+	}
+}
+
+// newOIDCOptions turns the validated oidc settings into options. OIDC sign
+// in is off when no issuer is configured.
+func newOIDCOptions(config *OIDCConfig) *OIDCOptions {
+	if config.Issuer == "" {
+		return nil
+	}
+
+	options := &OIDCOptions{
+		Issuer:        config.Issuer,
+		ClientID:      config.ClientID,
+		ClientSecret:  config.ClientSecret,
+		RedirectURL:   config.RedirectURL,
+		Scopes:        config.Scopes,
+		UsernameClaim: config.UsernameClaim,
+		RoleClaim:     config.RoleClaim,
+		RoleMap:       make(map[string]Role),
+		Only:          config.Only,
+	}
+
+	for value, role := range config.RoleMap {
+		options.RoleMap[value], _ = parseRole(role)
+	}
+
+	if config.DefaultRole != "" {
+		options.DefaultRole, _ = parseRole(config.DefaultRole)
+	}
+
+	return options
+}
+
+func (m *OIDCManager) IsEnabled() bool {
+	return m.Options != nil
+}
+
+// allowsPasswordLogin is false when OIDC_ONLY leaves single sign-on as the
+// only way in.
+func (m *OIDCManager) allowsPasswordLogin() bool {
+	return !m.IsEnabled() || !m.Options.Only
+}
+
+// getOAuth2Config discovers the provider on first use so the admin server
+// can start while the identity provider is unreachable.
+func (m *OIDCManager) getOAuth2Config(ctx context.Context) (*oauth2.Config, *oidc.Provider, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.provider == nil {
+		provider, err := oidc.NewProvider(ctx, m.Options.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.provider = provider
+	}
+
+	return &oauth2.Config{
+		ClientID:     m.Options.ClientID,
+		ClientSecret: m.Options.ClientSecret,
+		RedirectURL:  m.Options.RedirectURL,
+		Endpoint:     m.provider.Endpoint(),
+		Scopes:       m.Options.Scopes,
+	}, m.provider, nil
+}
+
+// getAuthCodeURL is where the browser goes to sign in, using PKCE with the
+// S256 challenge of verifier.
+func (m *OIDCManager) getAuthCodeURL(state string, nonce string, verifier string) (string, error) {
+	ctx, cancel := m.newContext()
+	defer cancel()
+
+	config, _, err := m.getOAuth2Config(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)), nil
+}
+
+// exchange trades the authorization code for tokens and returns the identity
+// in the verified ID token.
+func (m *OIDCManager) exchange(code string, verifier string, nonce string) (*OIDCIdentity, error) {
+	ctx, cancel := m.newContext()
+	defer cancel()
+
+	config, provider, err := m.getOAuth2Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("The identity provider didn't return an ID token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: m.Options.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+
+	claims := make(map[string]interface{})
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCIdentity{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Username: getOIDCUsername(claims, m.Options.UsernameClaim, idToken.Subject),
+		Role:     m.getRole(claims),
+	}, nil
+}
+
+// provisionUser finds the user linked to the identity, creating one on first
+// sign in. The provider is the source of truth for roles, so the user's role
+// is updated on every sign in.
+func (m *OIDCManager) provisionUser(identity *OIDCIdentity) (*UserRecord, error) {
+	if identity.Role == "" {
+		return nil, errOIDCNoRole
+	}
+
+	user, err := m.Repository.getUserRecordByOIDCSubject(identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		existing, err := m.Repository.getUserRecordByUsername(identity.Username)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, errOIDCUsernameTaken
+		}
+
+		userID := m.AppState.generateID()
+		err = m.Repository.createOIDCUserRecord(userID, identity.Username, identity.Role, identity.Issuer, identity.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Info("Provisioned user from OpenID Connect", "username", identity.Username, "role", identity.Role, "issuer", identity.Issuer)
+
+		return m.Repository.getUserRecord(userID)
+	}
+
+	if user.Disabled {
+		return nil, errInvalidCredentials
+	}
+
+	if user.Role != identity.Role {
+		err = m.Repository.updateUserRole(user.ID, identity.Role)
+		if err != nil {
+			return nil, err
+		}
+		user.Role = identity.Role
+	}
+
+	return user, nil
+}
+
+// getRole picks the highest role mapped from the role claim's values.
+func (m *OIDCManager) getRole(claims map[string]interface{}) Role {
+	role := m.Options.DefaultRole
+
+	for _, value := range getOIDCClaimValues(claims[m.Options.RoleClaim]) {
+		mapped, ok := m.Options.RoleMap[value]
+		if ok && (role == "" || !role.includes(mapped)) {
+			role = mapped
+		}
+	}
+
+	return role
+}
+
+func (m *OIDCManager) newContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	ctx = oidc.ClientContext(ctx, &http.Client{Timeout: oidcRequestTimeout})
+	return ctx, cancel
+}
+
+// getOIDCUsername names a user after the configured claim, then their email
+// address. An address is only used once the provider has verified it, so
+// nobody can take another person's username by entering their address.
+func getOIDCUsername(claims map[string]interface{}, claim string, subject string) string {
+	for _, name := range []string{claim, "email"} {
+		if name == "email" && !isOIDCEmailVerified(claims) {
+			continue
+		}
+
+		if value, ok := claims[name].(string); ok && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return subject
+}
+
+// isOIDCEmailVerified reads email_verified, which some providers send as a
+// string.
+func isOIDCEmailVerified(claims map[string]interface{}) bool {
+	switch value := claims["email_verified"].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+
+	return false
+}
+
+// getOIDCClaimValues accepts both single string and string array claims.
+func getOIDCClaimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				values = append(values, text)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	testOIDCClientID = "picfolio"
+	testOIDCCode     = "test-code"
+	testOIDCSubject  = "subject-1"
+)
+
+// testIdentityProvider is just enough of an OpenID Connect provider for
+// OIDCManager: discovery, keys and a token endpoint that checks the PKCE
+// verifier before handing out an ID token with Claims.
+type testIdentityProvider struct {
+	Server   *httptest.Server
+	Key      *rsa.PrivateKey
+	Verifier string
+	Claims   map[string]interface{}
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testIdentityProvider{Key: key, Claims: make(map[string]interface{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/keys", p.handleKeys)
+	mux.HandleFunc("/token", p.handleToken)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+
+	return p
+}
+
+func (p *testIdentityProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Server.URL,
+		"authorization_endpoint":                p.Server.URL + "/authorize",
+		"token_endpoint":                        p.Server.URL + "/token",
+		"jwks_uri":                              p.Server.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *testIdentityProvider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &p.Key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+func (p *testIdentityProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("code") != testOIDCCode || r.PostForm.Get("code_verifier") != p.Verifier {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.Server.URL,
+		"sub": testOIDCSubject,
+		"aud": testOIDCClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, value := range p.Claims {
+		claims[name] = value
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (p *testIdentityProvider) sign(claims map[string]interface{}) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.Key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return signature.CompactSerialize()
+}
+
+func newTestOIDCManager(p *testIdentityProvider, repository *Repository) *OIDCManager {
+	return newOIDCManager(&AppState{Repository: repository}, &OIDCOptions{
+		Issuer:        p.Server.URL,
+		ClientID:      testOIDCClientID,
+		ClientSecret:  "secret",
+		RedirectURL:   "http://picfolio.test/login/oidc/callback",
+		Scopes:        []string{"openid", "profile", "email"},
+		UsernameClaim: "preferred_username",
+		RoleClaim:     "groups",
+		RoleMap:       map[string]Role{"photographers": RoleUploader, "admins": RoleOwner},
+	})
+}
+
+func TestOIDCGetAuthCodeURL(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	m := newTestOIDCManager(p, nil)
+
+	authCodeURL, err := m.getAuthCodeURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := sha256.Sum256([]byte("verifier"))
+	expected := map[string]string{
+		"client_id":             testOIDCClientID,
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range expected {
+		if actual := parsed.Query().Get(name); actual != value {
+			t.Errorf("%s = %q, want %q", name, actual, value)
+		}
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		verifier    string
+		defaultRole Role
+		username    string
+		role        Role
+		fails       bool
+	}{
+		{
+			name:     "highest mapped role",
+			claims:   map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": []string{"photographers", "admins"}},
+			username: "alice",
+			role:     RoleOwner,
+		},
+		{
+			name:     "single group claim",
+			claims:   map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": "photographers"},
+			username: "alice",
+			role:     RoleUploader,
+		},
+		{
+			// provisionUser turns users without a role away.
+			name:     "no mapped group",
+			claims:   map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": []string{"visitors"}},
+			username: "alice",
+			role:     "",
+		},
+		{
+			name:        "default role",
+			claims:      map[string]interface{}{"nonce": "nonce", "preferred_username": "alice"},
+			defaultRole: RoleViewer,
+			username:    "alice",
+			role:        RoleViewer,
+		},
+		{
+			name:     "verified email",
+			claims:   map[string]interface{}{"nonce": "nonce", "email": "alice@example.com", "email_verified": true, "groups": "admins"},
+			username: "alice@example.com",
+			role:     RoleOwner,
+		},
+		{
+			name:     "unverified email",
+			claims:   map[string]interface{}{"nonce": "nonce", "email": "alice@example.com", "email_verified": false, "groups": "admins"},
+			username: testOIDCSubject,
+			role:     RoleOwner,
+		},
+		{
+			name:   "wrong nonce",
+			claims: map[string]interface{}{"nonce": "other", "preferred_username": "alice", "groups": "admins"},
+			fails:  true,
+		},
+		{
+			name:   "missing nonce",
+			claims: map[string]interface{}{"preferred_username": "alice", "groups": "admins"},
+			fails:  true,
+		},
+		{
+			name:     "wrong PKCE verifier",
+			claims:   map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": "admins"},
+			verifier: "other",
+			fails:    true,
+		},
+		{
+			name:   "token for another client",
+			claims: map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": "admins", "aud": "other"},
+			fails:  true,
+		},
+		{
+			name:   "expired token",
+			claims: map[string]interface{}{"nonce": "nonce", "preferred_username": "alice", "groups": "admins", "exp": time.Now().Add(-time.Hour).Unix()},
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestIdentityProvider(t)
+			p.Verifier = "verifier"
+			p.Claims = test.claims
+
+			m := newTestOIDCManager(p, nil)
+			m.Options.DefaultRole = test.defaultRole
+
+			verifier := test.verifier
+			if verifier == "" {
+				verifier = p.Verifier
+			}
+
+			identity, err := m.exchange(testOIDCCode, verifier, "nonce")
+			if test.fails {
+				if err == nil {
+					t.Fatalf("exchange succeeded with %+v, want an error", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+
+			if identity.Issuer != p.Server.URL || identity.Subject != testOIDCSubject {
+				t.Errorf("identity is %s %s, want %s %s", identity.Issuer, identity.Subject, p.Server.URL, testOIDCSubject)
+			}
+			if identity.Username != test.username {
+				t.Errorf("username = %q, want %q", identity.Username, test.username)
+			}
+			if identity.Role != test.role {
+				t.Errorf("role = %q, want %q", identity.Role, test.role)
+			}
+		})
+	}
+}
+
+func TestOIDCProvisionUser(t *testing.T) {
+	p := newTestIdentityProvider(t)
+	repository := newTestRepository(t)
+	m := newTestOIDCManager(p, repository)
+
+	identity := &OIDCIdentity{Issuer: p.Server.URL, Subject: testOIDCSubject, Username: "alice", Role: RoleUploader}
+
+	user, err := m.provisionUser(identity)
+	if err != nil {
+		t.Fatalf("provisionUser: %v", err)
+	}
+	if user.Username != "alice" || user.Role != RoleUploader || user.OIDCSubject == nil || *user.OIDCSubject != testOIDCSubject {
+		t.Fatalf("provisioned %+v, want alice linked to %s as %s", user, testOIDCSubject, RoleUploader)
+	}
+
+	// The provider decides the role on every sign in, and the user is found
+	// by subject even if their username changed.
+	identity.Role = RoleOwner
+	identity.Username = "alice.smith"
+	again, err := m.provisionUser(identity)
+	if err != nil {
+		t.Fatalf("provisionUser on the second sign in: %v", err)
+	}
+	if again.ID != user.ID || again.Role != RoleOwner {
+		t.Errorf("second sign in gave %s as %s, want %s as %s", again.ID, again.Role, user.ID, RoleOwner)
+	}
+
+	_, err = m.provisionUser(&OIDCIdentity{Issuer: p.Server.URL, Subject: "subject-2", Username: "alice", Role: RoleViewer})
+	if err != errOIDCUsernameTaken {
+		t.Errorf("provisionUser with a taken username = %v, want %v", err, errOIDCUsernameTaken)
+	}
+
+	_, err = m.provisionUser(&OIDCIdentity{Issuer: p.Server.URL, Subject: "subject-3", Username: "bob"})
+	if err != errOIDCNoRole {
+		t.Errorf("provisionUser without a role = %v, want %v", err, errOIDCNoRole)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultRenditionSizes = "320,650,1280,2048"
+
+// RenditionOptions describes the derived images generated for each upload.
+type RenditionOptions struct {
+	Sizes         []int
+	WebP          bool
+	ThumbnailSize int
+	JPEGQuality   int
+}
+
+// DisplayURL is the largest rendition, falling back to the thumbnail when no
+// renditions have been generated, as originals aren't served as images.
+func (r *ImageRecord) DisplayURL() string {
+	if len(r.Renditions) == 0 {
+		return getImageURL(getThumbnailFilePath(r.Path))
+	}
+
+	return r.Renditions[len(r.Renditions)-1].URL()
+}
+
+// SrcSet formats the renditions as an img srcset attribute value.
+func (r *ImageRecord) SrcSet() string {
+	candidates := make([]string, len(r.Renditions))
+	for i, rendition := range r.Renditions {
+		candidates[i] = fmt.Sprintf("%s %dw", rendition.URL(), rendition.Width)
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+func (r *RenditionRecord) URL() string {
+	return getImageURL(r.Path)
+}
+
+func getImageURL(key string) string {
+	return "/images/" + key
+}
+
+func parseRenditionSizes(value string) ([]int, error) {
+	sizes := make([]int, 0)
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		size, err := strconv.Atoi(part)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("Invalid rendition size %q", part)
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("At least one rendition size is required")
+	}
+
+	sort.Ints(sizes)
+
+	return sizes, nil
+}
+
+// isRenditionSetCurrent reports whether an image's renditions match what the
+// current options would generate for it.
+func isRenditionSetCurrent(image *ImageRecord, options *RenditionOptions) bool {
+	sizes := getRenditionSizes(options.Sizes, image.Width, image.Height)
+	if len(image.Renditions) != len(sizes) {
+		return false
+	}
+
+	for i, rendition := range image.Renditions {
+		if rendition.Size != sizes[i] {
+			return false
+		}
+		if options.WebP != (rendition.WebPPath != nil) {
+			return false
+		}
+	}
+
+	return true
+}
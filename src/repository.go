@@ -2,12 +2,19 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const imageColumns = "id, path, title, description, size, fileType, albumId, height, width, created, rotation, " +
+	"captured, cameraMake, cameraModel, lensModel, exposureTime, fNumber, focalLength, iso, latitude, longitude, " +
+	"headline, caption, creator, copyright, keywords, sha256, status"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
 type Repository struct {
 	Database *sql.DB
 }
@@ -19,15 +26,44 @@ func newRepository() *Repository {
 func (r *Repository) initRepository(dataSourceName string) {
 	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Unable to open the database", err)
 	}
 
-	_, err = db.Exec(initSQL)
+	r.Database = db
+
+	err = r.migrate()
 	if err != nil {
-		log.Fatal("%q: %s\n", err, initSQL)
+		fatal("Unable to migrate the database", err)
 	}
+}
 
-	r.Database = db
+// inTransaction runs fn in a transaction, committing if it succeeds and
+// rolling back if it returns an error.
+func (r *Repository) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := r.Database.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Repository) ping() error {
+	return r.Database.Ping()
+}
+
+func (r *Repository) close() error {
+	if r.Database == nil {
+		return nil
+	}
+
+	return r.Database.Close()
 }
 
 func (r *Repository) createAlbumRecord(id string, title string, description string) error {
@@ -47,21 +83,95 @@ func (r *Repository) createAlbumRecord(id string, title string, description stri
 	return nil
 }
 
-func (r *Repository) createImageRecord(id string, path string, title *string, size int64, fileType *string, albumID string, height int, width int) error {
-	stmt, err := r.Database.Prepare("insert into images (id, path, title, size, fileType, albumId, height, width, created) values (?,?,?,?,?,?,?,?,?)")
-	if err != nil {
+// createImageRecord inserts an image with its renditions and, once it's
+// ready, makes it the album's cover if the album doesn't have one. Either all
+// of it is saved or none of it is.
+func (r *Repository) createImageRecord(id string, path string, title *string, size int64, sha256 *string, fileType *string, albumID string, height int, width int, status string, metadata *ImageMetadata, renditions []*RenditionRecord, job *JobRecord) error {
+	return r.inTransaction(func(tx *sql.Tx) error {
+		// The album may have been deleted while the image was processed.
+		var albumCount int
+		err := tx.QueryRow("select count(*) from albums where id = ?", albumID).Scan(&albumCount)
+		if err != nil {
+			return err
+		}
+		if albumCount == 0 {
+			return errAlbumNotFound
+		}
+
+		now := time.Now().UTC()
+
+		_, err = tx.Exec("insert into images (id, path, title, size, fileType, albumId, height, width, created, "+
+			"captured, cameraMake, cameraModel, lensModel, exposureTime, fNumber, focalLength, iso, latitude, longitude, "+
+			"headline, caption, creator, copyright, keywords, sha256, status) values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			id, path, title, size, fileType, albumID, height, width, now,
+			metadata.Captured, metadata.CameraMake, metadata.CameraModel, metadata.LensModel, metadata.ExposureTime, metadata.FNumber, metadata.FocalLength, metadata.ISO, metadata.Latitude, metadata.Longitude,
+			metadata.Headline, metadata.Caption, metadata.Creator, metadata.Copyright, metadata.Keywords, sha256, status)
+		if err != nil {
+			return err
+		}
+
+		err = insertRenditionRecords(tx, id, renditions)
+		if err != nil {
+			return err
+		}
+
+		if job != nil {
+			_, err = insertJobRecord(tx, job.ID, job.Kind, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		if status != imageStatusReady {
+			return nil
+		}
+
+		_, err = tx.Exec("update albums set coverPhotoId = ? where id = ? and coverPhotoId is null", id, albumID)
 		return err
-	}
-	defer stmt.Close()
+	})
+}
 
-	now := time.Now().UTC()
+// completeImageRecord saves what processing an upload found out about it and
+// marks it ready, making it the album's cover if the album doesn't have one.
+func (r *Repository) completeImageRecord(id string, height int, width int, metadata *ImageMetadata, renditions []*RenditionRecord) error {
+	return r.inTransaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec("update images set height = ?, width = ?, "+
+			"captured = ?, cameraMake = ?, cameraModel = ?, lensModel = ?, exposureTime = ?, fNumber = ?, focalLength = ?, iso = ?, latitude = ?, longitude = ?, "+
+			"headline = ?, caption = ?, creator = ?, copyright = ?, keywords = ?, status = ? where id = ?",
+			height, width,
+			metadata.Captured, metadata.CameraMake, metadata.CameraModel, metadata.LensModel, metadata.ExposureTime, metadata.FNumber, metadata.FocalLength, metadata.ISO, metadata.Latitude, metadata.Longitude,
+			metadata.Headline, metadata.Caption, metadata.Creator, metadata.Copyright, metadata.Keywords, imageStatusReady, id)
+		if err != nil {
+			return err
+		}
 
-	_, err = stmt.Exec(id, path, title, size, fileType, albumID, height, width, now)
-	if err != nil {
+		// The image may have been deleted while it was processed.
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errImageNotFound
+		}
+
+		_, err = tx.Exec("delete from renditions where imageId = ?", id)
+		if err != nil {
+			return err
+		}
+
+		err = insertRenditionRecords(tx, id, renditions)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("update albums set coverPhotoId = ? where id = (select albumId from images where id = ?) and coverPhotoId is null", id, id)
 		return err
-	}
+	})
+}
 
-	return nil
+func (r *Repository) setImageStatus(imageID string, status string) error {
+	_, err := r.Database.Exec("update images set status = ? where id = ?", status, imageID)
+	return err
 }
 
 func (r *Repository) getAllAlbumRecords() ([]*AlbumRecord, error) {
@@ -111,7 +221,7 @@ func (r *Repository) getAlbumRecord(id string) (*AlbumRecord, error) {
 }
 
 func (r *Repository) getAllImageRecordsByAlbumID(albumID string) ([]*ImageRecord, error) {
-	stmt, err := r.Database.Prepare("select id, path, title, description, size, fileType, albumId, height, width, created from images where albumId = ?")
+	stmt, err := r.Database.Prepare("select " + imageColumns + " from images where albumId = ?")
 	if err != nil {
 		return nil, err
 	}
@@ -126,8 +236,7 @@ func (r *Repository) getAllImageRecordsByAlbumID(albumID string) ([]*ImageRecord
 	var records = make([]*ImageRecord, 0)
 
 	for rows.Next() {
-		record := &ImageRecord{}
-		err = rows.Scan(&record.ID, &record.Path, &record.Title, &record.Description, &record.Size, &record.FileType, &record.AlbumID, &record.Height, &record.Width, &record.Created)
+		record, err := scanImageRecord(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -144,7 +253,7 @@ func (r *Repository) getAllImageRecordsByAlbumID(albumID string) ([]*ImageRecord
 }
 
 func (r *Repository) getAllImageRecords() ([]*ImageRecord, error) {
-	rows, err := r.Database.Query("select id, path, title, description, size, fileType, albumId, height, width, created from images")
+	rows, err := r.Database.Query("select " + imageColumns + " from images")
 	if err != nil {
 		return nil, err
 	}
@@ -153,8 +262,7 @@ func (r *Repository) getAllImageRecords() ([]*ImageRecord, error) {
 	var records = make([]*ImageRecord, 0)
 
 	for rows.Next() {
-		record := &ImageRecord{}
-		err = rows.Scan(&record.ID, &record.Path, &record.Title, &record.Description, &record.Size, &record.FileType, &record.AlbumID, &record.Height, &record.Width, &record.Created)
+		record, err := scanImageRecord(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -171,15 +279,17 @@ func (r *Repository) getAllImageRecords() ([]*ImageRecord, error) {
 }
 
 func (r *Repository) getImageRecord(id string) (*ImageRecord, error) {
-	stmt, err := r.Database.Prepare("select id, path, title, description, size, fileType, albumId, height, width, created from images where id = ?")
+	stmt, err := r.Database.Prepare("select " + imageColumns + " from images where id = ?")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	var record = &ImageRecord{}
-	err = stmt.QueryRow(id).Scan(&record.ID, &record.Path, &record.Title, &record.Description, &record.Size, &record.FileType, &record.AlbumID, &record.Height, &record.Width, &record.Created)
+	record, err := scanImageRecord(stmt.QueryRow(id))
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
 		return nil, err
 	}
 
@@ -216,14 +326,108 @@ func (r *Repository) updateAlbum(albumID string, title string, description *stri
 	return nil
 }
 
+// deleteAlbum removes an album with its images, renditions and permissions
+// in one transaction.
 func (r *Repository) deleteAlbum(albumID string) error {
-	stmt, err := r.Database.Prepare("delete from albums where id = ?")
+	return r.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("delete from renditions where imageId in (select id from images where albumId = ?)", albumID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from jobs where imageId in (select id from images where albumId = ?) and status = ?", albumID, jobStatusQueued)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from images where albumId = ?", albumID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from albumPermissions where albumId = ?", albumID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from albums where id = ?", albumID)
+		return err
+	})
+}
+
+// resetCoverPhoto points an album's cover at its oldest image, or at none
+// when the album is empty.
+func (r *Repository) resetCoverPhoto(albumID string) error {
+	_, err := r.Database.Exec("update albums set coverPhotoId = (select id from images where albumId = albums.id and status = 'ready' order by created, id limit 1) where id = ?", albumID)
+	return err
+}
+
+// deleteImage removes an image and its renditions in one transaction. An
+// album using the image as its cover falls back to its oldest remaining
+// image, or to no cover when it was the last one.
+func (r *Repository) deleteImage(imageID string) error {
+	return r.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("delete from renditions where imageId = ?", imageID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from jobs where imageId = ? and status = ?", imageID, jobStatusQueued)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("delete from images where id = ?", imageID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("update albums set coverPhotoId = (select id from images where albumId = albums.id and status = 'ready' order by created, id limit 1) where coverPhotoId = ?", imageID)
+		return err
+	})
+}
+
+// rotateImageRecord turns a ready image a quarter turn and queues job to
+// remake its derived images, in one statement so quick rotations add up
+// rather than overwrite each other.
+func (r *Repository) rotateImageRecord(imageID string, job *JobRecord) error {
+	return r.inTransaction(func(tx *sql.Tx) error {
+		var status string
+		err := tx.QueryRow("select status from images where id = ?", imageID).Scan(&status)
+		if err == sql.ErrNoRows {
+			return errImageNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// Processing sets the size from the original, which would undo the
+		// swap.
+		if status != imageStatusReady {
+			return errImageProcessing
+		}
+
+		_, err = tx.Exec("update images set rotation = (rotation + 90) % 360, width = height, height = width where id = ?", imageID)
+		if err != nil {
+			return err
+		}
+
+		_, err = insertJobRecord(tx, job.ID, job.Kind, imageID)
+		return err
+	})
+}
+
+// updateImage saves the fields users edit. Size and rotation are left to
+// rotateImageRecord and processing, so an edit can't undo a rotation made
+// while it was open.
+func (r *Repository) updateImage(imageID string, record *ImageRecord) error {
+	stmt, err := r.Database.Prepare("update images set description = ?, albumId = ? where id = ?")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(albumID)
+	_, err = stmt.Exec(record.Description, record.AlbumID, imageID)
 	if err != nil {
 		return err
 	}
@@ -231,47 +435,118 @@ func (r *Repository) deleteAlbum(albumID string) error {
 	return nil
 }
 
-func (r *Repository) deleteImagesByAlbumID(albumID string) error {
-	stmt, err := r.Database.Prepare("delete from images where albumId = ?")
+// setRenditionRecords replaces an image's renditions, unless the image was
+// deleted while they were made.
+func (r *Repository) setRenditionRecords(imageID string, renditions []*RenditionRecord) error {
+	return r.inTransaction(func(tx *sql.Tx) error {
+		var imageCount int
+		err := tx.QueryRow("select count(*) from images where id = ?", imageID).Scan(&imageCount)
+		if err != nil {
+			return err
+		}
+		if imageCount == 0 {
+			return errImageNotFound
+		}
+
+		_, err = tx.Exec("delete from renditions where imageId = ?", imageID)
+		if err != nil {
+			return err
+		}
+
+		return insertRenditionRecords(tx, imageID, renditions)
+	})
+}
+
+func insertRenditionRecords(tx *sql.Tx, imageID string, renditions []*RenditionRecord) error {
+	now := time.Now().UTC()
+
+	for _, rendition := range renditions {
+		_, err := tx.Exec("insert into renditions (imageId, size, path, width, height, bytes, webpPath, webpBytes, created) values (?,?,?,?,?,?,?,?,?)",
+			imageID, rendition.Size, rendition.Path, rendition.Width, rendition.Height, rendition.Bytes, rendition.WebPPath, rendition.WebPBytes, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) getRenditionRecordsByImageID(imageID string) ([]*RenditionRecord, error) {
+	rows, err := r.Database.Query("select imageId, size, path, width, height, bytes, webpPath, webpBytes, created from renditions where imageId = ? order by size", imageID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(albumID)
+	return scanRenditionRecords(rows)
+}
+
+func (r *Repository) getAllRenditionRecordsByAlbumID(albumID string) ([]*RenditionRecord, error) {
+	rows, err := r.Database.Query("select imageId, size, path, width, height, bytes, webpPath, webpBytes, created from renditions where imageId in (select id from images where albumId = ?) order by imageId, size", albumID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return scanRenditionRecords(rows)
 }
 
-func (r *Repository) deleteImage(imageID string) error {
-	stmt, err := r.Database.Prepare("delete from images where id = ?")
+func (r *Repository) getAllRenditionRecords() ([]*RenditionRecord, error) {
+	rows, err := r.Database.Query("select imageId, size, path, width, height, bytes, webpPath, webpBytes, created from renditions order by imageId, size")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(imageID)
+	return scanRenditionRecords(rows)
+}
+
+func scanRenditionRecords(rows *sql.Rows) ([]*RenditionRecord, error) {
+	defer rows.Close()
+
+	var records = make([]*RenditionRecord, 0)
+
+	for rows.Next() {
+		record := &RenditionRecord{}
+		err := rows.Scan(&record.ImageID, &record.Size, &record.Path, &record.Width, &record.Height, &record.Bytes, &record.WebPPath, &record.WebPBytes, &record.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err := rows.Err()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return records, nil
 }
 
-func (r *Repository) updateImage(imageID string, record *ImageRecord) error {
-	stmt, err := r.Database.Prepare("update images set description = ?, height = ?, width = ?, albumId = ? where id = ?")
+func scanImageRecord(row rowScanner) (*ImageRecord, error) {
+	record := &ImageRecord{}
+	metadata := &record.Metadata
+
+	err := row.Scan(&record.ID, &record.Path, &record.Title, &record.Description, &record.Size, &record.FileType, &record.AlbumID, &record.Height, &record.Width, &record.Created, &record.Rotation,
+		&metadata.Captured, &metadata.CameraMake, &metadata.CameraModel, &metadata.LensModel, &metadata.ExposureTime, &metadata.FNumber, &metadata.FocalLength, &metadata.ISO, &metadata.Latitude, &metadata.Longitude,
+		&metadata.Headline, &metadata.Caption, &metadata.Creator, &metadata.Copyright, &metadata.Keywords, &record.SHA256, &record.Status)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(record.Description, record.Height, record.Width, record.AlbumID, imageID)
+	return record, nil
+}
+
+// getLibraryTotals counts albums and images and adds up the bytes recorded
+// for originals and renditions.
+func (r *Repository) getLibraryTotals() (*LibraryTotals, error) {
+	totals := &LibraryTotals{}
+
+	err := r.Database.QueryRow("select (select count(*) from albums), (select count(*) from images), "+
+		"(select coalesce(sum(size), 0) from images), (select coalesce(sum(bytes), 0) from renditions), "+
+		"(select coalesce(sum(webpBytes), 0) from renditions)").
+		Scan(&totals.Albums, &totals.Images, &totals.OriginalBytes, &totals.RenditionBytes, &totals.WebPBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return totals, nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const jobColumns = "id, kind, imageId, status, attempts, error, runAfter, created, updated"
+
+// createJobRecord queues a job unless the image already has one of the same
+// kind waiting, which will see the latest state of the image when it runs.
+// It reports whether a job was added.
+func (r *Repository) createJobRecord(id string, kind string, imageID string) (bool, error) {
+	var created bool
+
+	err := r.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		created, err = insertJobRecord(tx, id, kind, imageID)
+		return err
+	})
+
+	return created, err
+}
+
+func insertJobRecord(tx *sql.Tx, id string, kind string, imageID string) (bool, error) {
+	now := time.Now().UTC()
+
+	result, err := tx.Exec("insert into jobs (id, kind, imageId, status, attempts, runAfter, created, updated) "+
+		"select ?, ?, ?, ?, 0, ?, ?, ? where not exists (select 1 from jobs where imageId = ? and kind = ? and status = ?)",
+		id, kind, imageID, jobStatusQueued, now, now, now, imageID, kind, jobStatusQueued)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// claimJobRecord marks the oldest job that's due as running and returns it,
+// or nil when nothing is due. Jobs wait while another job of the same image
+// is running, so they don't race to write its derived images. Callers must
+// not claim concurrently.
+func (r *Repository) claimJobRecord(now time.Time) (*JobRecord, error) {
+	record, err := scanJobRecord(r.Database.QueryRow("select "+jobColumns+" from jobs where status = ? and runAfter <= ? "+
+		"and imageId not in (select imageId from jobs where status = ?) order by runAfter, created limit 1", jobStatusQueued, now.UTC(), jobStatusRunning))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	record.Status = jobStatusRunning
+	record.Attempts++
+	record.Updated = now.UTC()
+
+	_, err = r.Database.Exec("update jobs set status = ?, attempts = ?, updated = ? where id = ?", record.Status, record.Attempts, record.Updated, record.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// updateJobRecord records the outcome of a job's attempt.
+func (r *Repository) updateJobRecord(id string, status string, errorMessage *string, runAfter time.Time) error {
+	_, err := r.Database.Exec("update jobs set status = ?, error = ?, runAfter = ?, updated = ? where id = ?", status, errorMessage, runAfter.UTC(), time.Now().UTC(), id)
+	return err
+}
+
+// requeueRunningJobRecords puts jobs that were running when the app last
+// stopped back in the queue.
+func (r *Repository) requeueRunningJobRecords() (int64, error) {
+	result, err := r.Database.Exec("update jobs set status = ?, updated = ? where status = ?", jobStatusQueued, time.Now().UTC(), jobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// getUnqueuedProcessingImageIDs finds images waiting to be processed that
+// have no job to do it, such as when queueing failed after the upload.
+func (r *Repository) getUnqueuedProcessingImageIDs() ([]string, error) {
+	rows, err := r.Database.Query("select id from images where status = ? and id not in (select imageId from jobs where status in (?, ?))", imageStatusProcessing, jobStatusQueued, jobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	imageIDs := make([]string, 0)
+
+	for rows.Next() {
+		var imageID string
+		err = rows.Scan(&imageID)
+		if err != nil {
+			return nil, err
+		}
+
+		imageIDs = append(imageIDs, imageID)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return imageIDs, nil
+}
+
+// getLatestJobRecordsByAlbumID returns the most recent job of each image in
+// the album that has one.
+func (r *Repository) getLatestJobRecordsByAlbumID(albumID string) ([]*JobRecord, error) {
+	rows, err := r.Database.Query("select "+jobColumns+" from jobs where imageId in (select id from images where albumId = ?) "+
+		"and created = (select max(created) from jobs latest where latest.imageId = jobs.imageId) order by created", albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*JobRecord, 0)
+
+	for rows.Next() {
+		record, err := scanJobRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// deleteFinishedJobRecords removes jobs that finished or gave up before
+// before.
+func (r *Repository) deleteFinishedJobRecords(before time.Time) (int64, error) {
+	result, err := r.Database.Exec("delete from jobs where status in (?, ?) and updated < ?", jobStatusDone, jobStatusFailed, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (r *Repository) countJobRecordsByStatus() (map[string]int, error) {
+	rows, err := r.Database.Query("select status, count(*) from jobs group by status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		var status string
+		var count int
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[status] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func scanJobRecord(row rowScanner) (*JobRecord, error) {
+	record := &JobRecord{}
+
+	err := row.Scan(&record.ID, &record.Kind, &record.ImageID, &record.Status, &record.Attempts, &record.Error, &record.RunAfter, &record.Created, &record.Updated)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
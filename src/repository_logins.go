@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+)
+
+const loginAttemptColumns = "id, username, ipAddress, success, reason, userAgent, created"
+
+func (r *Repository) createLoginAttemptRecord(record *LoginAttemptRecord) error {
+	stmt, err := r.Database.Prepare("insert into loginAttempts (username, ipAddress, success, reason, userAgent, created) values (?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(record.Username, record.IPAddress, record.Success, record.Reason, record.UserAgent, record.Created)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getLoginFailureTimes returns the newest failures for a username or IP
+// address since since, at most limit of them. With sinceLastSuccess, failures
+// before its last successful sign in aren't counted either. Failures with the
+// ignored reason are never counted.
+func (r *Repository) getLoginFailureTimes(column string, value string, ignoredReason string, since time.Time, sinceLastSuccess bool, limit int) ([]time.Time, error) {
+	if column != "username" && column != "ipAddress" {
+		panic("unsupported login attempt column " + column)
+	}
+
+	query := `select created from loginAttempts
+		where ` + column + ` = ? and success = 0 and reason <> ? and created > ?`
+	args := []interface{}{value, ignoredReason, since}
+	if sinceLastSuccess {
+		query += ` and created > coalesce((select max(created) from loginAttempts where ` + column + ` = ? and success = 1), '')`
+		args = append(args, value)
+	}
+
+	rows, err := r.Database.Query(query+" order by created desc limit ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures = make([]time.Time, 0)
+
+	for rows.Next() {
+		var created time.Time
+		err = rows.Scan(&created)
+		if err != nil {
+			return nil, err
+		}
+
+		failures = append(failures, created)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+func (r *Repository) getLoginAttemptRecords(failuresOnly bool, limit int) ([]*LoginAttemptRecord, error) {
+	query := "select " + loginAttemptColumns + " from loginAttempts"
+	if failuresOnly {
+		query += " where success = 0"
+	}
+
+	rows, err := r.Database.Query(query+" order by created desc limit ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*LoginAttemptRecord, 0)
+
+	for rows.Next() {
+		record := &LoginAttemptRecord{}
+		err = rows.Scan(&record.ID, &record.Username, &record.IPAddress, &record.Success, &record.Reason, &record.UserAgent, &record.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *Repository) deleteLoginAttemptRecordsBefore(before time.Time) error {
+	_, err := r.Database.Exec("delete from loginAttempts where created < ?", before)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const sessionColumns = "sessions.id, sessions.userId, sessions.data, sessions.userAgent, sessions.ipAddress, sessions.created, sessions.lastSeen, sessions.expires, users.username"
+
+const sessionJoin = " from sessions left join users on users.id = sessions.userId"
+
+func (r *Repository) getSessionKeyRecords() ([]*SessionKeyRecord, error) {
+	rows, err := r.Database.Query("select id, hashKey, blockKey, created from sessionKeys order by created desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*SessionKeyRecord, 0)
+
+	for rows.Next() {
+		record := &SessionKeyRecord{}
+		err = rows.Scan(&record.ID, &record.HashKey, &record.BlockKey, &record.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *Repository) createSessionKeyRecord(record *SessionKeyRecord) error {
+	_, err := r.Database.Exec("insert into sessionKeys (id, hashKey, blockKey, created) values (?,?,?,?)", record.ID, record.HashKey, record.BlockKey, record.Created)
+	return err
+}
+
+func (r *Repository) deleteSessionKeyRecord(id string) error {
+	_, err := r.Database.Exec("delete from sessionKeys where id = ?", id)
+	return err
+}
+
+func (r *Repository) getSessionRecord(id string) (*SessionRecord, error) {
+	stmt, err := r.Database.Prepare("select " + sessionColumns + sessionJoin + " where sessions.id = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	record, err := scanSessionRecord(stmt.QueryRow(id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// getActiveSessionRecords lists unexpired signed in sessions, limited to one
+// user when userID isn't empty.
+func (r *Repository) getActiveSessionRecords(userID string, now time.Time) ([]*SessionRecord, error) {
+	query := "select " + sessionColumns + sessionJoin + " where sessions.userId is not null and sessions.expires > ?"
+	args := []interface{}{now}
+	if userID != "" {
+		query += " and sessions.userId = ?"
+		args = append(args, userID)
+	}
+
+	rows, err := r.Database.Query(query+" order by sessions.lastSeen desc", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*SessionRecord, 0)
+
+	for rows.Next() {
+		record, err := scanSessionRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *Repository) saveSessionRecord(record *SessionRecord) error {
+	stmt, err := r.Database.Prepare(`insert into sessions (id, userId, data, userAgent, ipAddress, created, lastSeen, expires) values (?,?,?,?,?,?,?,?)
+		on conflict(id) do update set userId = excluded.userId, data = excluded.data, userAgent = excluded.userAgent, ipAddress = excluded.ipAddress, lastSeen = excluded.lastSeen, expires = excluded.expires`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(record.ID, record.UserID, record.Data, record.UserAgent, record.IPAddress, record.Created, record.LastSeen, record.Expires)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) updateSessionLastSeen(id string, lastSeen time.Time, ipAddress string) error {
+	_, err := r.Database.Exec("update sessions set lastSeen = ?, ipAddress = ? where id = ?", lastSeen, ipAddress, id)
+	return err
+}
+
+func (r *Repository) deleteSessionRecord(id string) error {
+	_, err := r.Database.Exec("delete from sessions where id = ?", id)
+	return err
+}
+
+func (r *Repository) deleteSessionRecordsByUserID(userID string) error {
+	_, err := r.Database.Exec("delete from sessions where userId = ?", userID)
+	return err
+}
+
+func (r *Repository) deleteExpiredSessionRecords(now time.Time) error {
+	_, err := r.Database.Exec("delete from sessions where expires <= ?", now)
+	return err
+}
+
+func scanSessionRecord(row rowScanner) (*SessionRecord, error) {
+	record := &SessionRecord{}
+
+	err := row.Scan(&record.ID, &record.UserID, &record.Data, &record.UserAgent, &record.IPAddress, &record.Created, &record.LastSeen, &record.Expires, &record.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
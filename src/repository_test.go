@@ -0,0 +1,17 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestRepository opens a migrated database that's removed after the test.
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+
+	r := newRepository()
+	r.initRepository(filepath.Join(t.TempDir(), "picfolio.db"))
+	t.Cleanup(func() { r.close() })
+
+	return r
+}
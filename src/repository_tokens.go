@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const apiTokenColumns = "id, userId, name, tokenHash, expires, lastUsed, created"
+
+func (r *Repository) createAPITokenRecord(record *APITokenRecord) error {
+	stmt, err := r.Database.Prepare("insert into apiTokens (" + apiTokenColumns + ") values (?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(record.ID, record.UserID, record.Name, record.TokenHash, record.Expires, record.LastUsed, record.Created)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) getAPITokenRecordByHash(tokenHash string) (*APITokenRecord, error) {
+	stmt, err := r.Database.Prepare("select " + apiTokenColumns + " from apiTokens where tokenHash = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	record, err := scanAPITokenRecord(stmt.QueryRow(tokenHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *Repository) getAPITokenRecordsByUserID(userID string) ([]*APITokenRecord, error) {
+	rows, err := r.Database.Query("select "+apiTokenColumns+" from apiTokens where userId = ? order by created desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*APITokenRecord, 0)
+
+	for rows.Next() {
+		record, err := scanAPITokenRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *Repository) updateAPITokenLastUsed(id string, lastUsed time.Time) error {
+	_, err := r.Database.Exec("update apiTokens set lastUsed = ? where id = ?", lastUsed, id)
+	return err
+}
+
+// deleteAPITokenRecord removes a token owned by the user and reports whether
+// one was found.
+func (r *Repository) deleteAPITokenRecord(userID string, id string) (bool, error) {
+	result, err := r.Database.Exec("delete from apiTokens where userId = ? and id = ?", userID, id)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func scanAPITokenRecord(row rowScanner) (*APITokenRecord, error) {
+	record := &APITokenRecord{}
+
+	err := row.Scan(&record.ID, &record.UserID, &record.Name, &record.TokenHash, &record.Expires, &record.LastUsed, &record.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const userColumns = "id, username, passwordHash, role, disabled, created, totpSecret, totpLastCounter, oidcIssuer, oidcSubject"
+
+func (r *Repository) createUserRecord(id string, username string, passwordHash *string, role Role) error {
+	stmt, err := r.Database.Prepare("insert into users (id, username, passwordHash, role, disabled, created) values (?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+
+	_, err = stmt.Exec(id, username, passwordHash, role, false, now)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createOIDCUserRecord adds a user already linked to an OpenID Connect
+// identity, in one insert so there's never a user the identity can't sign
+// in as.
+func (r *Repository) createOIDCUserRecord(id string, username string, role Role, issuer string, subject string) error {
+	_, err := r.Database.Exec("insert into users (id, username, role, disabled, oidcIssuer, oidcSubject, created) values (?,?,?,?,?,?,?)",
+		id, username, role, false, issuer, subject, time.Now().UTC())
+	return err
+}
+
+func (r *Repository) getUserRecord(id string) (*UserRecord, error) {
+	return r.getUserRecordWhere("id = ?", id)
+}
+
+func (r *Repository) getUserRecordByUsername(username string) (*UserRecord, error) {
+	return r.getUserRecordWhere("username = ?", username)
+}
+
+func (r *Repository) getUserRecordByOIDCSubject(issuer string, subject string) (*UserRecord, error) {
+	return r.getUserRecordWhere("oidcIssuer = ? and oidcSubject = ?", issuer, subject)
+}
+
+func (r *Repository) getUserRecordWhere(condition string, args ...interface{}) (*UserRecord, error) {
+	stmt, err := r.Database.Prepare("select " + userColumns + " from users where " + condition)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	record, err := scanUserRecord(stmt.QueryRow(args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	record.AlbumPermissions, err = r.getAlbumPermissions(record.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (r *Repository) getAllUserRecords() ([]*UserRecord, error) {
+	rows, err := r.Database.Query("select " + userColumns + " from users order by username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records = make([]*UserRecord, 0)
+
+	for rows.Next() {
+		record, err := scanUserRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		record.AlbumPermissions, err = r.getAlbumPermissions(record.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+func (r *Repository) getUserCount() (int, error) {
+	var count int
+	err := r.Database.QueryRow("select count(*) from users").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r *Repository) updateUserPassword(id string, passwordHash *string) error {
+	_, err := r.Database.Exec("update users set passwordHash = ? where id = ?", passwordHash, id)
+	return err
+}
+
+func (r *Repository) updateUserRole(id string, role Role) error {
+	_, err := r.Database.Exec("update users set role = ? where id = ?", role, id)
+	return err
+}
+
+func (r *Repository) updateUserDisabled(id string, disabled bool) error {
+	_, err := r.Database.Exec("update users set disabled = ? where id = ?", disabled, id)
+	return err
+}
+
+func (r *Repository) updateUserTOTP(id string, secret *string, lastCounter *int64) error {
+	_, err := r.Database.Exec("update users set totpSecret = ?, totpLastCounter = ? where id = ?", secret, lastCounter, id)
+	return err
+}
+
+// updateUserTOTPCounter records the last accepted TOTP counter, failing the
+// update when a concurrent login already used this counter or a later one.
+func (r *Repository) updateUserTOTPCounter(id string, counter int64) (bool, error) {
+	result, err := r.Database.Exec("update users set totpLastCounter = ? where id = ? and (totpLastCounter is null or totpLastCounter < ?)", counter, id, counter)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// setRecoveryCodes replaces the user's recovery codes.
+func (r *Repository) setRecoveryCodes(userID string, codeHashes []string) error {
+	tx, err := r.Database.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from recoveryCodes where userId = ?", userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec("insert into recoveryCodes (userId, codeHash, created) values (?,?,?)", userID, codeHash, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// useRecoveryCode marks an unused recovery code as used and reports whether
+// one matched.
+func (r *Repository) useRecoveryCode(userID string, codeHash string) (bool, error) {
+	result, err := r.Database.Exec("update recoveryCodes set used = ? where userId = ? and codeHash = ? and used is null", time.Now().UTC(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (r *Repository) getUnusedRecoveryCodeCount(userID string) (int, error) {
+	var count int
+	err := r.Database.QueryRow("select count(*) from recoveryCodes where userId = ? and used is null", userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r *Repository) deleteRecoveryCodes(userID string) error {
+	_, err := r.Database.Exec("delete from recoveryCodes where userId = ?", userID)
+	return err
+}
+
+func (r *Repository) getAlbumPermissions(userID string) (map[string]Role, error) {
+	rows, err := r.Database.Query("select albumId, role from albumPermissions where userId = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]Role)
+
+	for rows.Next() {
+		var albumID string
+		var role Role
+		err = rows.Scan(&albumID, &role)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions[albumID] = role
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (r *Repository) setAlbumPermission(userID string, albumID string, role Role) error {
+	_, err := r.Database.Exec("insert or replace into albumPermissions (userId, albumId, role) values (?,?,?)", userID, albumID, role)
+	return err
+}
+
+func (r *Repository) deleteAlbumPermission(userID string, albumID string) error {
+	_, err := r.Database.Exec("delete from albumPermissions where userId = ? and albumId = ?", userID, albumID)
+	return err
+}
+
+func scanUserRecord(row rowScanner) (*UserRecord, error) {
+	record := &UserRecord{}
+
+	err := row.Scan(&record.ID, &record.Username, &record.PasswordHash, &record.Role, &record.Disabled, &record.Created, &record.TOTPSecret, &record.TOTPLastCounter, &record.OIDCIssuer, &record.OIDCSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
@@ -1,31 +1,57 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
-
-	"github.com/gorilla/securecookie"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
 const SessionCookieName string = "picfolio.session"
+
+// OIDCStateCookieName holds single sign-on state between /login/oidc and
+// the callback.
+const OIDCStateCookieName string = "picfolio.oidc"
 const SessionDuration int = 86400
 
+const sessionUserIDKey = "userId"
+
+type contextKey string
+
+const currentUserContextKey contextKey = "currentUser"
+
 type AdminServer struct {
-	Port             string
-	AdminCredentials *Credentials
-	Router           *mux.Router
-	CookieStore      *sessions.CookieStore
-	AppState         *AppState
-	ImageManager     *ImageManager
-	AlbumManager     *AlbumManager
+	Address        string
+	Server         *http.Server
+	Router         *mux.Router
+	SessionStore   sessions.Store
+	OIDCStateStore sessions.Store
+	AppState       *AppState
+	ImageManager   *ImageManager
+	AlbumManager   *AlbumManager
+	UserManager    *UserManager
+	TokenManager   *TokenManager
+	SessionManager *SessionManager
+	LoginThrottle  *LoginThrottle
+	TwoFactor      *TwoFactorManager
+	OIDC           *OIDCManager
+	Integrity      *IntegrityManager
+	Tus            *TusManager
+	Jobs           *JobQueue
 }
 
 type Credentials struct {
@@ -34,125 +60,423 @@ type Credentials struct {
 }
 
 type LoginPageData struct {
-	IsError      bool
-	ErrorMessage string
+	CSRFToken       string
+	OIDCEnabled     bool
+	PasswordEnabled bool
+	IsError         bool
+	IsLockedOut     bool
+	ErrorMessage    string
+}
+
+// AdminPage holds what the admin wrapper template needs on every page.
+type AdminPage struct {
+	CurrentUser *UserRecord
+	CSRFToken   string
 }
 
 type AdminPageData struct {
+	AdminPage
 	Albums []*AlbumRecord
 }
 
+type TokensPageData struct {
+	AdminPage
+	Tokens       []*APITokenRecord
+	NewToken     string
+	IsError      bool
+	ErrorMessage string
+}
+
+type SessionsPageData struct {
+	AdminPage
+	CurrentSessionID string
+	IsServerSide     bool
+	Sessions         []*SessionRecord
+}
+
+type LibraryPageData struct {
+	AdminPage
+	Report  *IntegrityReport
+	IsFixed bool
+}
+
+// AlbumJob is the latest background job of an image in an album, which the
+// album pages poll while images are being processed.
+type AlbumJob struct {
+	ImageID  string    `json:"imageId"`
+	Kind     string    `json:"kind"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    *string   `json:"error"`
+	Updated  time.Time `json:"updated"`
+}
+
 type AlbumPageData struct {
-	Album  *AlbumRecord
-	Images []*ImageRecord
+	AdminPage
+	Album     *AlbumRecord
+	Images    []*ImageRecord
+	CanUpload bool
+	CanEdit   bool
 }
 
 func newAdminServer(a *AppState) *AdminServer {
 	adminKey := os.Getenv("ADMIN_KEY")
 
-	var adminCredentials *Credentials
-	if adminKey == "" {
-		log.Println("Missing ADMIN_KEY.")
-	} else {
-		adminCredentials = getBase64Credentials(adminKey)
+	if adminKey != "" && !a.OIDCManager.allowsPasswordLogin() {
+		slog.Warn("Ignoring ADMIN_KEY since OIDC_ONLY disables password sign in")
+	} else if adminKey != "" {
+		err := a.UserManager.bootstrapOwner(getBase64Credentials(adminKey))
+		if err != nil {
+			slog.Error("Unable to create owner account from ADMIN_KEY", "error", err)
+		}
+	}
+
+	sessionStore, err := a.SessionManager.newSessionStore()
+	if err != nil {
+		fatal("Unable to set up the session store", err)
+	}
+
+	oidcStateStore, err := a.SessionManager.newOIDCStateStore()
+	if err != nil {
+		fatal("Unable to set up the session store", err)
 	}
 
 	return &AdminServer{
-		Port:             "8080",
-		AdminCredentials: adminCredentials,
-		Router:           mux.NewRouter(),
-		CookieStore:      sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
-		AppState:         a,
-		ImageManager:     a.ImageManager,
-		AlbumManager:     a.AlbumManager,
+		Address:        a.Config.Server.AdminAddress,
+		Router:         mux.NewRouter(),
+		SessionStore:   sessionStore,
+		OIDCStateStore: oidcStateStore,
+		AppState:       a,
+		ImageManager:   a.ImageManager,
+		AlbumManager:   a.AlbumManager,
+		UserManager:    a.UserManager,
+		TokenManager:   a.TokenManager,
+		SessionManager: a.SessionManager,
+		LoginThrottle:  newLoginThrottle(a.Repository),
+		TwoFactor:      a.TwoFactorManager,
+		OIDC:           a.OIDCManager,
+		Integrity:      a.IntegrityManager,
+		Tus:            a.TusManager,
+		Jobs:           a.JobQueue,
 	}
 }
 
 func (s *AdminServer) startListeningAdmin() {
-	if s.AdminCredentials == nil {
+	userCount, err := s.AppState.Repository.getUserCount()
+	if err != nil {
+		slog.Error("Unable to count users", "error", err)
+		return
+	}
+
+	if userCount == 0 && !s.OIDC.IsEnabled() {
+		slog.Warn("No admin accounts exist. Set ADMIN_KEY, OIDC_ISSUER or run 'picfolio user create' to enable the admin server.")
 		return
 	}
 
+	s.Router.Use(s.AppState.Metrics.middleware("admin"))
+	s.Router.Use(s.csrfMiddleware)
+
 	s.Router.Handle("/", http.RedirectHandler("login", http.StatusFound))
 
 	s.Router.HandleFunc("/login", s.handleLoginPage)
-	s.Router.Handle("/logout", s.authHandler(s.handleLogout))
-	s.Router.Handle("/admin", s.authHandler(s.handleAdminPage))
-	s.Router.Handle("/upload/{albumID}", s.authHandler(s.handleUpload)).Methods("POST")
-	s.Router.Handle("/image/{imageID}", s.authHandler(s.handleImageUpdate)).Methods("POST")
-	s.Router.Handle("/image/{imageID}", s.authHandler(s.handleImageDelete)).Methods("DELETE")
-	s.Router.Handle("/image/{imageID}/rotate", s.authHandler(s.handleImageRotate)).Methods("POST")
-	s.Router.Handle("/album", s.authHandler(s.handleAlbumCreate)).Methods("POST")
-	s.Router.Handle("/album/{albumID}", s.authHandler(s.handleAlbumUpdate)).Methods("POST")
-	s.Router.Handle("/album/{albumID}", s.authHandler(s.handleAlbumDelete)).Methods("DELETE")
-	s.Router.Handle("/album/{albumID}", s.authHandler(s.handleAlbumPage))
-	s.Router.Handle("/album/{albumID}/edit", s.authHandler(s.handleAlbumEditPage))
-
+	s.Router.HandleFunc("/login/2fa", s.handleLoginTwoFactorPage).Methods("GET", "POST")
+	if s.OIDC.IsEnabled() {
+		s.Router.HandleFunc("/login/oidc", s.handleOIDCLogin).Methods("GET")
+		s.Router.HandleFunc("/login/oidc/callback", s.handleOIDCCallback).Methods("GET")
+	}
+	s.Router.Handle("/logout", s.authHandler(RoleViewer, s.handleLogout))
+	s.Router.Handle("/admin", s.authHandler(RoleViewer, s.handleAdminPage))
+	s.Router.Handle("/upload/{albumID}", s.authHandler(RoleUploader, s.handleUpload)).Methods("POST")
+	s.Router.Handle("/image/{imageID}", s.authHandler(RoleEditor, s.handleImageUpdate)).Methods("POST")
+	s.Router.Handle("/image/{imageID}", s.authHandler(RoleEditor, s.handleImageDelete)).Methods("DELETE")
+	s.Router.Handle("/image/{imageID}/rotate", s.authHandler(RoleEditor, s.handleImageRotate)).Methods("POST")
+	s.Router.Handle("/image/{imageID}/original", s.authHandler(RoleViewer, s.handleImageOriginal)).Methods("GET")
+	s.Router.Handle("/album", s.authHandler(RoleEditor, s.handleAlbumCreate)).Methods("POST")
+	s.Router.Handle("/album/{albumID}", s.authHandler(RoleEditor, s.handleAlbumUpdate)).Methods("POST")
+	s.Router.Handle("/album/{albumID}", s.authHandler(RoleEditor, s.handleAlbumDelete)).Methods("DELETE")
+	s.Router.Handle("/album/{albumID}", s.authHandler(RoleViewer, s.handleAlbumPage))
+	s.Router.Handle("/album/{albumID}/edit", s.authHandler(RoleEditor, s.handleAlbumEditPage))
+	s.Router.Handle("/album/{albumID}/jobs", s.authHandler(RoleViewer, s.handleAlbumJobs)).Methods("GET")
+	s.Router.Handle("/album/{albumID}/events", s.authHandler(RoleViewer, s.handleAlbumEvents)).Methods("GET")
+	s.Router.Handle("/tokens", s.authHandler(RoleViewer, s.handleTokensPage)).Methods("GET")
+	s.Router.Handle("/tokens", s.authHandler(RoleViewer, s.handleTokenCreate)).Methods("POST")
+	s.Router.Handle("/tokens/{tokenID}", s.authHandler(RoleViewer, s.handleTokenDelete)).Methods("DELETE")
+	s.Router.Handle("/sessions", s.authHandler(RoleViewer, s.handleSessionsPage)).Methods("GET")
+	s.Router.Handle("/sessions/{sessionID}", s.authHandler(RoleViewer, s.handleSessionDelete)).Methods("DELETE")
+	s.Router.Handle("/library", s.authHandler(RoleOwner, s.handleLibraryPage)).Methods("GET")
+	s.Router.Handle("/library/fix", s.authHandler(RoleOwner, s.handleLibraryFix)).Methods("POST")
+	s.Router.Handle("/account/security", s.authHandler(RoleViewer, s.handleSecurityPage)).Methods("GET")
+	s.Router.Handle("/account/security/qr.png", s.authHandler(RoleViewer, s.handleSecurityQRCode)).Methods("GET")
+	s.Router.Handle("/account/security/enable", s.authHandler(RoleViewer, s.handleTwoFactorEnable)).Methods("POST")
+	s.Router.Handle("/account/security/disable", s.authHandler(RoleViewer, s.handleTwoFactorDisable)).Methods("POST")
+	s.Router.Handle("/account/security/recovery-codes", s.authHandler(RoleViewer, s.handleRecoveryCodesRegenerate)).Methods("POST")
+
+	s.addTusRoutes()
+	s.addAPIRoutes()
 	s.addCommonRoutes()
 
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%s", s.Port), s.Router); err != nil {
-			panic(err)
-		}
-		s.AppState.exitCallback <- true
-	}()
+	if s.AppState.Config.Metrics.Address == "" {
+		addHealthRoutes(s.AppState, s.Router)
+	}
 
-	log.Printf("Admin server started on port %s", s.Port)
+	s.Server = newHTTPServer(s.Address, loggingMiddleware("admin", s.Router), &s.AppState.Config.Server)
+	// Event streams only end when the page closes, so they're ended for
+	// shutdown rather than waited for.
+	s.Server.RegisterOnShutdown(s.AppState.UploadEvents.close)
+	s.AppState.listen(s.Server)
+
+	slog.Info("Admin server started", "address", s.Address)
 }
 
-func (s *AdminServer) authHandler(f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+func (s *AdminServer) authHandler(role Role, f func(w http.ResponseWriter, r *http.Request)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		isAuthorized, _ := checkIsAuthorized(s, r)
-		if !isAuthorized {
+		user, status := s.checkAccess(r, role)
+		switch status {
+		case http.StatusUnauthorized:
+			if _, ok := getBearerToken(r); ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, errInvalidAPIToken.Error(), status)
+				return
+			}
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
+		case http.StatusOK:
+			r, err := s.withCSRFToken(w, r)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+			f(w, r.WithContext(context.WithValue(r.Context(), currentUserContextKey, user)))
+			return
 		}
-		f(w, r)
+		http.Error(w, http.StatusText(status), status)
 	})
 }
 
+// checkAccess finds the signed in or token authenticated user and checks
+// their role against the one required. Requests for an album or image are
+// checked against the user's role within that album.
+func (s *AdminServer) checkAccess(r *http.Request, role Role) (*UserRecord, int) {
+	user, err := s.getRequestUser(r)
+	if err != nil {
+		getLogger(r).Error("Unable to authenticate request", "error", err)
+		return nil, http.StatusInternalServerError
+	}
+	if user == nil {
+		return nil, http.StatusUnauthorized
+	}
+
+	albumID, err := s.getRequestAlbumID(r)
+	if err != nil {
+		getLogger(r).Error("Unable to find the request's album", "error", err)
+		return nil, http.StatusInternalServerError
+	}
+
+	userRole := user.Role
+	if albumID != "" {
+		userRole = user.getAlbumRole(albumID)
+	}
+
+	if !userRole.includes(role) {
+		return user, http.StatusForbidden
+	}
+
+	return user, http.StatusOK
+}
+
+func (s *AdminServer) getRequestAlbumID(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+
+	if albumID, ok := vars["albumID"]; ok {
+		return albumID, nil
+	}
+
+	if imageID, ok := vars["imageID"]; ok {
+		image, err := s.AppState.Repository.getImageRecord(imageID)
+		if err != nil || image == nil {
+			return "", err
+		}
+		return image.AlbumID, nil
+	}
+
+	return "", nil
+}
+
+// getRequestUser authenticates a request by its bearer token when one is sent
+// and by the session cookie otherwise.
+func (s *AdminServer) getRequestUser(r *http.Request) (*UserRecord, error) {
+	token, ok := getBearerToken(r)
+	if !ok {
+		return s.getSessionUser(r)
+	}
+
+	user, err := s.TokenManager.authenticateToken(token)
+	if err == errInvalidAPIToken {
+		return nil, nil
+	}
+
+	return user, err
+}
+
+func (s *AdminServer) getSessionUser(r *http.Request) (*UserRecord, error) {
+	session, err := s.SessionStore.Get(r, SessionCookieName)
+	if session == nil && err != nil {
+		return nil, err
+	}
+
+	userID, ok := session.Values[sessionUserIDKey].(string)
+	if !ok || userID == "" {
+		return nil, nil
+	}
+
+	user, err := s.UserManager.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func getBearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[7:]), true
+}
+
+func newAdminPage(r *http.Request) AdminPage {
+	return AdminPage{
+		CurrentUser: getCurrentUser(r),
+		CSRFToken:   getCSRFToken(r),
+	}
+}
+
+func getCurrentUser(r *http.Request) *UserRecord {
+	user, _ := r.Context().Value(currentUserContextKey).(*UserRecord)
+	return user
+}
+
 func (s *AdminServer) handleLoginPage(w http.ResponseWriter, r *http.Request) {
-	isAuthorized, _ := checkIsAuthorized(s, r)
-	if isAuthorized {
+	currentUser, _ := s.getSessionUser(r)
+	if currentUser != nil {
 		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
 
 	data := &LoginPageData{}
+	s.setLoginOptions(data)
 
-	if r.Method == "POST" {
-		username := r.FormValue("username")
-		password := r.FormValue("password")
+	if r.Method == "POST" && s.handleLogin(w, r, data) {
+		return
+	}
 
-		if username == s.AdminCredentials.Username && password == s.AdminCredentials.Password {
-			session, err := s.CookieStore.Get(r, SessionCookieName)
+	tmpl := template.Must(template.ParseFiles("www/admin/login.html", "www/common_head.html", "www/common_foot.html"))
 
-			if session == nil && err != nil {
-				log.Println(err)
-				return
-			}
+	tmpl.Execute(w, data)
+}
 
-			// Expires after 24 hours
-			session.Options.MaxAge = SessionDuration
+// handleLogin signs the user in, returning true once it has responded.
+// Otherwise data describes why sign in failed.
+func (s *AdminServer) handleLogin(w http.ResponseWriter, r *http.Request, data *LoginPageData) bool {
+	if !data.PasswordEnabled {
+		w.WriteHeader(http.StatusForbidden)
+		data.IsError = true
+		data.ErrorMessage = "Password sign in is disabled, use single sign-on instead"
+		return false
+	}
 
-			session.Save(r, w)
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	ipAddress := getClientIP(r)
 
-			http.Redirect(w, r, "/admin", http.StatusFound)
-			return
-		}
+	status, err := s.LoginThrottle.check(username, ipAddress)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	if status.RetryAfter > 0 {
+		s.recordLoginAttempt(r, username, false, loginReasonThrottled)
+
+		w.Header().Set("Retry-After", strconv.Itoa(int((status.RetryAfter+time.Second-1)/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		data.IsError = true
+		data.IsLockedOut = status.LockedOut
+		data.ErrorMessage = status.Message()
+		return false
+	}
+
+	user, err := s.UserManager.authenticate(username, password)
+	if err == errInvalidCredentials {
+		s.recordLoginAttempt(r, username, false, loginReasonInvalidCredentials)
 
 		w.WriteHeader(http.StatusUnauthorized)
 		data.IsError = true
-		data.ErrorMessage = "Incorrect username or password"
+		data.ErrorMessage = err.Error()
+		return false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return true
 	}
 
-	tmpl := template.Must(template.ParseFiles("www/admin/login.html", "www/common_head.html", "www/common_foot.html"))
+	if user.HasTwoFactor() {
+		return s.startTwoFactorLogin(w, r, user)
+	}
 
-	tmpl.Execute(w, data)
+	s.recordLoginAttempt(r, username, true, "")
+
+	return s.startSession(w, r, user)
+}
+
+// startSession signs the user in on a fresh session and sends them to the
+// admin page.
+func (s *AdminServer) startSession(w http.ResponseWriter, r *http.Request, user *UserRecord) bool {
+	session, err := s.SessionStore.Get(r, SessionCookieName)
+
+	if session == nil && err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	err = s.SessionManager.renewSession(session)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	// Expires after 24 hours
+	session.Options.MaxAge = SessionDuration
+	delete(session.Values, sessionPendingUserIDKey)
+	delete(session.Values, sessionPendingSinceKey)
+	session.Values[sessionUserIDKey] = user.ID
+	setCSRFToken(session)
+
+	err = session.Save(r, w)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+	return true
+}
+
+func (s *AdminServer) recordLoginAttempt(r *http.Request, username string, success bool, reason string) {
+	err := s.LoginThrottle.record(username, getClientIP(r), r.UserAgent(), success, reason)
+	if err != nil {
+		getLogger(r).Error("Unable to record login attempt", "error", err)
+	}
 }
 
 func (s *AdminServer) handleLogout(w http.ResponseWriter, r *http.Request) {
-	session, _ := s.CookieStore.Get(r, SessionCookieName)
+	session, _ := s.SessionStore.Get(r, SessionCookieName)
 
 	if !session.IsNew {
 		session.Options.MaxAge = -1
@@ -163,14 +487,15 @@ func (s *AdminServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *AdminServer) handleAdminPage(w http.ResponseWriter, r *http.Request) {
-	albumRecords, err := s.AlbumManager.getAllAlbums()
+	albumRecords, err := s.AlbumManager.getAlbumsForUser(getCurrentUser(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
 	data := &AdminPageData{
-		Albums: albumRecords,
+		AdminPage: newAdminPage(r),
+		Albums:    albumRecords,
 	}
 
 	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/album_list.html"))
@@ -182,27 +507,52 @@ func (s *AdminServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	albumID := vars["albumID"]
 
-	uploadProfiles, err := uploadFiles(s.AppState, r)
-	if uploadProfiles != nil && len(uploadProfiles) > 0 {
-		for _, uploadProfile := range uploadProfiles {
-			s.ImageManager.createImage(albumID, uploadProfile)
-		}
+	_, err := s.uploadImages(w, r, albumID)
+	if uploadErr, ok := err.(*UploadError); ok {
+		http.Error(w, uploadErr.Message, uploadErr.Status)
+		return
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/album/%s", albumID), http.StatusFound)
 }
 
+// uploadImages creates an image in the album for every file in a multipart
+// upload, returning their IDs. Either every file becomes an image or none
+// does, so a client can retry a failed upload without creating duplicates.
+func (s *AdminServer) uploadImages(w http.ResponseWriter, r *http.Request, albumID string) ([]string, error) {
+	uploadProfiles, err := uploadFiles(s.AppState, w, r)
+	if err != nil {
+		s.AppState.UploadEvents.publishRejected(albumID, err)
+		return nil, err
+	}
+
+	imageIDs := make([]string, 0)
+
+	for i, uploadProfile := range uploadProfiles {
+		imageID, err := s.ImageManager.createImage(albumID, uploadProfile)
+		if err != nil {
+			removeUploadFiles(uploadProfiles[i+1:])
+			s.ImageManager.discardImages(albumID, imageIDs)
+			return nil, err
+		}
+
+		imageIDs = append(imageIDs, imageID)
+	}
+
+	return imageIDs, nil
+}
+
 func (s *AdminServer) handleAlbumCreate(w http.ResponseWriter, r *http.Request) {
 	title := r.FormValue("title")
 	description := r.FormValue("description")
 
-	albumID, err := s.AlbumManager.createAlbum(title, description)
+	albumID, err := s.AlbumManager.createAlbumForUser(getCurrentUser(r), title, description)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -215,7 +565,7 @@ func (s *AdminServer) handleAlbumPage(w http.ResponseWriter, r *http.Request) {
 
 	albumRecord, err := s.AlbumManager.getAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -226,27 +576,127 @@ func (s *AdminServer) handleAlbumPage(w http.ResponseWriter, r *http.Request) {
 
 	imageRecords, err := s.ImageManager.getAllImagesByAlbumID(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
-	data := &AlbumPageData{
-		Album:  albumRecord,
-		Images: imageRecords,
-	}
+	data := s.newAlbumPageData(r, albumRecord, imageRecords)
 
 	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/album.html", "www/photoswipe.html"))
 
 	tmpl.Execute(w, data)
 }
 
+func (s *AdminServer) handleAlbumJobs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	albumID := vars["albumID"]
+
+	albumRecord, err := s.AlbumManager.getAlbum(albumID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if albumRecord == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	jobRecords, err := s.Jobs.getLatestJobsByAlbumID(albumID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	jobs := make([]*AlbumJob, len(jobRecords))
+	for i, jobRecord := range jobRecords {
+		jobs[i] = &AlbumJob{
+			ImageID:  jobRecord.ImageID,
+			Kind:     jobRecord.Kind,
+			Status:   jobRecord.Status,
+			Attempts: jobRecord.Attempts,
+			Error:    jobRecord.Error,
+			Updated:  jobRecord.Updated,
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleAlbumEvents streams the album's upload events as Server-Sent Events,
+// see https://html.spec.whatwg.org/multipage/server-sent-events.html.
+func (s *AdminServer) handleAlbumEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	albumID := vars["albumID"]
+
+	albumRecord, err := s.AlbumManager.getAlbum(albumID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if albumRecord == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The stream stays open for as long as the page does, well past the
+	// server's write timeout.
+	controller := http.NewResponseController(w)
+	err = controller.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		serverError(w, r, err)
+		return
+	}
+
+	events, unsubscribe := s.AppState.UploadEvents.subscribe(albumID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+
+	keepAlive := time.NewTicker(uploadEventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				getLogger(r).Error("Unable to encode upload event", "error", err)
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		controller.Flush()
+	}
+}
+
 func (s *AdminServer) handleAlbumUpdate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	albumID := vars["albumID"]
 
 	currentAlbum, err := s.AlbumManager.getAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	if currentAlbum == nil {
@@ -262,9 +712,21 @@ func (s *AdminServer) handleAlbumUpdate(w http.ResponseWriter, r *http.Request)
 		title = currentAlbum.Title
 	}
 
+	if coverPhotoID != nil {
+		isAlbumImage, err := s.ImageManager.isAlbumImage(albumID, *coverPhotoID)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if !isAlbumImage {
+			http.Error(w, errCoverPhotoNotInAlbum.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	err = s.AlbumManager.updateAlbum(albumID, title, description, coverPhotoID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -277,7 +739,7 @@ func (s *AdminServer) handleAlbumDelete(w http.ResponseWriter, r *http.Request)
 
 	currentAlbum, err := s.AlbumManager.getAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	if currentAlbum == nil {
@@ -287,7 +749,7 @@ func (s *AdminServer) handleAlbumDelete(w http.ResponseWriter, r *http.Request)
 
 	err = s.AlbumManager.deleteAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -300,7 +762,7 @@ func (s *AdminServer) handleImageUpdate(w http.ResponseWriter, r *http.Request)
 
 	currentImage, err := s.ImageManager.getImage(imageID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	if currentImage == nil {
@@ -312,7 +774,7 @@ func (s *AdminServer) handleImageUpdate(w http.ResponseWriter, r *http.Request)
 
 	err = s.ImageManager.updateImage(imageID, currentImage)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -325,7 +787,7 @@ func (s *AdminServer) handleImageDelete(w http.ResponseWriter, r *http.Request)
 
 	currentImage, err := s.ImageManager.getImage(imageID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	if currentImage == nil {
@@ -335,7 +797,7 @@ func (s *AdminServer) handleImageDelete(w http.ResponseWriter, r *http.Request)
 
 	err = s.ImageManager.deleteImage(imageID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -347,14 +809,48 @@ func (s *AdminServer) handleImageRotate(w http.ResponseWriter, r *http.Request)
 	imageID := vars["imageID"]
 
 	err := s.ImageManager.rotateImage(imageID)
+	if err == errImageNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err == errImageProcessing {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *AdminServer) handleImageOriginal(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	imageID := vars["imageID"]
+
+	image, reader, err := s.ImageManager.getOriginalImage(imageID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if image == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer reader.Close()
+
+	fileName := path.Base(image.Path)
+	if image.Title != nil {
+		fileName = *image.Title
+	}
+
+	w.Header().Set("Content-Type", getContentType(image.Path))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+
+	io.Copy(w, reader)
+}
+
 func nilString(str string) *string {
 	if str == "" {
 		return nil
@@ -368,7 +864,7 @@ func (s *AdminServer) handleAlbumEditPage(w http.ResponseWriter, r *http.Request
 
 	albumRecord, err := s.AlbumManager.getAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -379,28 +875,198 @@ func (s *AdminServer) handleAlbumEditPage(w http.ResponseWriter, r *http.Request
 
 	imageRecords, err := s.ImageManager.getAllImagesByAlbumID(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
-	data := &AlbumPageData{
-		Album:  albumRecord,
-		Images: imageRecords,
-	}
+	data := s.newAlbumPageData(r, albumRecord, imageRecords)
 
 	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/album_edit.html"))
 
 	tmpl.Execute(w, data)
 }
 
-func checkIsAuthorized(s *AdminServer, r *http.Request) (bool, error) {
-	session, err := s.CookieStore.Get(r, SessionCookieName)
+func (s *AdminServer) handleTokensPage(w http.ResponseWriter, r *http.Request) {
+	s.renderTokensPage(w, r, &TokensPageData{})
+}
+
+func (s *AdminServer) handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
 
-	if session == nil && err != nil {
-		return false, err
+	data := &TokensPageData{}
+
+	var expires *time.Time
+	if days := r.FormValue("expiresDays"); days != "" && days != "0" {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			http.Error(w, "Invalid token expiry", http.StatusBadRequest)
+			return
+		}
+		expiry := time.Now().UTC().AddDate(0, 0, count)
+		expires = &expiry
+	}
+
+	token, _, err := s.TokenManager.createToken(getCurrentUser(r).ID, r.FormValue("name"), expires)
+	if err != nil && err != errAPITokenNameRequired && err != errAPITokenExpired {
+		serverError(w, r, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.IsError = true
+		data.ErrorMessage = err.Error()
+	} else {
+		data.NewToken = token
 	}
 
-	return !session.IsNew, nil
+	s.renderTokensPage(w, r, data)
+}
+
+func (s *AdminServer) handleTokenDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	tokenID := vars["tokenID"]
+
+	err := s.TokenManager.revokeToken(getCurrentUser(r).ID, tokenID)
+	if err == errAPITokenNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) renderTokensPage(w http.ResponseWriter, r *http.Request, data *TokensPageData) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	data.AdminPage = newAdminPage(r)
+
+	tokens, err := s.TokenManager.getUserTokens(data.CurrentUser.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	data.Tokens = tokens
+
+	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/tokens.html"))
+
+	tmpl.Execute(w, data)
+}
+
+// handleLibraryPage checks the library and lists what --fix would repair.
+func (s *AdminServer) handleLibraryPage(w http.ResponseWriter, r *http.Request) {
+	report, err := s.Integrity.verify()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	s.renderLibraryPage(w, &LibraryPageData{AdminPage: newAdminPage(r), Report: report})
+}
+
+// handleLibraryFix checks the library again rather than trusting the report
+// the page showed, then repairs what it finds.
+func (s *AdminServer) handleLibraryFix(w http.ResponseWriter, r *http.Request) {
+	report, err := s.Integrity.verify()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	s.Integrity.fix(report)
+
+	for _, issue := range report.Issues {
+		if issue.Error != "" {
+			getLogger(r).Warn("Unable to fix library problem", "kind", issue.Kind, "key", issue.Key, "error", issue.Error)
+		}
+	}
+
+	s.renderLibraryPage(w, &LibraryPageData{AdminPage: newAdminPage(r), Report: report, IsFixed: true})
+}
+
+func (s *AdminServer) renderLibraryPage(w http.ResponseWriter, data *LibraryPageData) {
+	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/library.html"))
+
+	tmpl.Execute(w, data)
+}
+
+func (s *AdminServer) handleSessionsPage(w http.ResponseWriter, r *http.Request) {
+	data := &SessionsPageData{
+		AdminPage:    newAdminPage(r),
+		IsServerSide: s.SessionManager.IsServerSide(),
+	}
+
+	if data.IsServerSide {
+		session, _ := s.SessionStore.Get(r, SessionCookieName)
+		data.CurrentSessionID = session.ID
+
+		sessionRecords, err := s.SessionManager.getActiveSessions(data.CurrentUser)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		data.Sessions = sessionRecords
+	}
+
+	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/sessions.html"))
+
+	tmpl.Execute(w, data)
+}
+
+func (s *AdminServer) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	sessionID := vars["sessionID"]
+
+	err := s.SessionManager.revokeSession(getCurrentUser(r), sessionID)
+	if err == errSessionNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkSessionOnly stops API tokens from being used to manage API tokens and
+// sessions.
+func checkSessionOnly(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := getBearerToken(r); ok {
+		http.Error(w, "This action requires signing in", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (s *AdminServer) newAlbumPageData(r *http.Request, album *AlbumRecord, images []*ImageRecord) *AlbumPageData {
+	page := newAdminPage(r)
+	albumRole := page.CurrentUser.getAlbumRole(album.ID)
+
+	return &AlbumPageData{
+		AdminPage: page,
+		Album:     album,
+		Images:    images,
+		CanUpload: albumRole.includes(RoleUploader),
+		CanEdit:   albumRole.includes(RoleEditor),
+	}
 }
 
 func getBase64Credentials(encoded string) *Credentials {
@@ -410,7 +1076,7 @@ func getBase64Credentials(encoded string) *Credentials {
 
 	decoded, err := decodeBase64(encoded)
 	if err != nil {
-		log.Printf("Unable to decode credentials: %v", err)
+		slog.Error("Unable to decode credentials", "error", err)
 		return nil
 	}
 
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const apiPrefix = "/api/v1"
+
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type APIAlbum struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Description  *string   `json:"description"`
+	CoverPhotoID *string   `json:"coverPhotoId"`
+	Created      time.Time `json:"created"`
+}
+
+type APIImage struct {
+	ID           string          `json:"id"`
+	AlbumID      string          `json:"albumId"`
+	Title        *string         `json:"title"`
+	Description  *string         `json:"description"`
+	FileType     *string         `json:"fileType"`
+	Size         int64           `json:"size"`
+	SHA256       *string         `json:"sha256"`
+	Status       string          `json:"status"`
+	Width        int             `json:"width"`
+	Height       int             `json:"height"`
+	Rotation     int             `json:"rotation"`
+	Created      time.Time       `json:"created"`
+	Metadata     ImageMetadata   `json:"metadata"`
+	OriginalURL  string          `json:"originalUrl"`
+	ThumbnailURL string          `json:"thumbnailUrl"`
+	Renditions   []*APIRendition `json:"renditions"`
+}
+
+type APIRendition struct {
+	Size    int     `json:"size"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	URL     string  `json:"url"`
+	WebPURL *string `json:"webpUrl"`
+}
+
+type APIAlbumRequest struct {
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	CoverPhotoID *string `json:"coverPhotoId"`
+}
+
+type APIImageRequest struct {
+	Description *string `json:"description"`
+}
+
+type APICoverRequest struct {
+	ImageID string `json:"imageId"`
+}
+
+type APIAlbumList struct {
+	Albums []*APIAlbum `json:"albums"`
+}
+
+type APIImageList struct {
+	Images []*APIImage `json:"images"`
+}
+
+func (s *AdminServer) addAPIRoutes() {
+	api := s.Router.PathPrefix(apiPrefix).Subrouter()
+
+	api.Handle("/openapi.yaml", s.apiAuthHandler(RoleViewer, s.handleAPISpec)).Methods("GET")
+	api.Handle("/albums", s.apiAuthHandler(RoleViewer, s.handleAPIAlbumList)).Methods("GET")
+	api.Handle("/albums", s.apiAuthHandler(RoleEditor, s.handleAPIAlbumCreate)).Methods("POST")
+	api.Handle("/albums/{albumID}", s.apiAuthHandler(RoleViewer, s.handleAPIAlbumGet)).Methods("GET")
+	api.Handle("/albums/{albumID}", s.apiAuthHandler(RoleEditor, s.handleAPIAlbumUpdate)).Methods("PATCH")
+	api.Handle("/albums/{albumID}", s.apiAuthHandler(RoleEditor, s.handleAPIAlbumDelete)).Methods("DELETE")
+	api.Handle("/albums/{albumID}/cover", s.apiAuthHandler(RoleEditor, s.handleAPIAlbumCover)).Methods("PUT")
+	api.Handle("/albums/{albumID}/images", s.apiAuthHandler(RoleViewer, s.handleAPIImageList)).Methods("GET")
+	api.Handle("/albums/{albumID}/images", s.apiAuthHandler(RoleUploader, s.handleAPIImageUpload)).Methods("POST")
+	api.Handle("/images/{imageID}", s.apiAuthHandler(RoleViewer, s.handleAPIImageGet)).Methods("GET")
+	api.Handle("/images/{imageID}", s.apiAuthHandler(RoleEditor, s.handleAPIImageUpdate)).Methods("PATCH")
+	api.Handle("/images/{imageID}", s.apiAuthHandler(RoleEditor, s.handleAPIImageDelete)).Methods("DELETE")
+	api.Handle("/images/{imageID}/rotate", s.apiAuthHandler(RoleEditor, s.handleAPIImageRotate)).Methods("POST")
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "Resource not found")
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+}
+
+func (s *AdminServer) apiAuthHandler(role Role, f func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, status := s.checkAccess(r, role)
+		switch status {
+		case http.StatusUnauthorized:
+			if _, ok := getBearerToken(r); ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, status, errInvalidAPIToken.Error())
+				return
+			}
+			writeAPIError(w, status, "Authentication required")
+			return
+		case http.StatusForbidden:
+			writeAPIError(w, status, "Your role doesn't allow this action")
+			return
+		case http.StatusOK:
+			f(w, r.WithContext(context.WithValue(r.Context(), currentUserContextKey, user)))
+			return
+		}
+		writeAPIError(w, status, http.StatusText(status))
+	})
+}
+
+func (s *AdminServer) handleAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	http.ServeFile(w, r, "www/api/openapi.yaml")
+}
+
+func (s *AdminServer) handleAPIAlbumList(w http.ResponseWriter, r *http.Request) {
+	albumRecords, err := s.AlbumManager.getAlbumsForUser(getCurrentUser(r))
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	albums := make([]*APIAlbum, len(albumRecords))
+	for i, albumRecord := range albumRecords {
+		albums[i] = newAPIAlbum(albumRecord)
+	}
+
+	writeJSON(w, http.StatusOK, &APIAlbumList{Albums: albums})
+}
+
+func (s *AdminServer) handleAPIAlbumCreate(w http.ResponseWriter, r *http.Request) {
+	request := &APIAlbumRequest{}
+	if !readJSON(w, r, request) {
+		return
+	}
+
+	if request.Title == nil || *request.Title == "" {
+		writeAPIError(w, http.StatusBadRequest, "Title is required")
+		return
+	}
+
+	description := ""
+	if request.Description != nil {
+		description = *request.Description
+	}
+
+	albumID, err := s.AlbumManager.createAlbumForUser(getCurrentUser(r), *request.Title, description)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	albumRecord, err := s.AlbumManager.getAlbum(albumID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", apiPrefix+"/albums/"+albumID)
+	writeJSON(w, http.StatusCreated, newAPIAlbum(albumRecord))
+}
+
+func (s *AdminServer) handleAPIAlbumGet(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIAlbum(albumRecord))
+}
+
+func (s *AdminServer) handleAPIAlbumUpdate(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	request := &APIAlbumRequest{}
+	if !readJSON(w, r, request) {
+		return
+	}
+
+	title := albumRecord.Title
+	if request.Title != nil {
+		if *request.Title == "" {
+			writeAPIError(w, http.StatusBadRequest, "Title can't be empty")
+			return
+		}
+		title = *request.Title
+	}
+
+	description := albumRecord.Description
+	if request.Description != nil {
+		description = nilString(*request.Description)
+	}
+
+	coverPhotoID := albumRecord.CoverPhotoID
+	if request.CoverPhotoID != nil {
+		if !s.checkAPICoverPhoto(w, r, albumRecord.ID, *request.CoverPhotoID) {
+			return
+		}
+		coverPhotoID = request.CoverPhotoID
+	}
+
+	err := s.AlbumManager.updateAlbum(albumRecord.ID, title, description, coverPhotoID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	s.writeAPIAlbum(w, r, albumRecord.ID)
+}
+
+func (s *AdminServer) handleAPIAlbumDelete(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.AlbumManager.deleteAlbum(albumRecord.ID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleAPIAlbumCover(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	request := &APICoverRequest{}
+	if !readJSON(w, r, request) {
+		return
+	}
+
+	if !s.checkAPICoverPhoto(w, r, albumRecord.ID, request.ImageID) {
+		return
+	}
+
+	err := s.AlbumManager.setAlbumCoverPhoto(albumRecord.ID, request.ImageID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	s.writeAPIAlbum(w, r, albumRecord.ID)
+}
+
+func (s *AdminServer) handleAPIImageList(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	imageRecords, err := s.ImageManager.getAllImagesByAlbumID(albumRecord.ID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIImageList(imageRecords))
+}
+
+func (s *AdminServer) handleAPIImageUpload(w http.ResponseWriter, r *http.Request) {
+	albumRecord, ok := s.getAPIAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	imageIDs, err := s.uploadImages(w, r, albumRecord.ID)
+	if uploadErr, ok := err.(*UploadError); ok {
+		writeAPIError(w, uploadErr.Status, uploadErr.Message)
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	if len(imageIDs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "No files were uploaded")
+		return
+	}
+
+	imageRecords := make([]*ImageRecord, 0)
+
+	for _, imageID := range imageIDs {
+		imageRecord, err := s.ImageManager.getImage(imageID)
+		if err != nil {
+			writeAPIServerError(w, r, err)
+			return
+		}
+
+		imageRecords = append(imageRecords, imageRecord)
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIImageList(imageRecords))
+}
+
+func (s *AdminServer) handleAPIImageGet(w http.ResponseWriter, r *http.Request) {
+	imageRecord, ok := s.getAPIImage(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIImage(imageRecord))
+}
+
+func (s *AdminServer) handleAPIImageUpdate(w http.ResponseWriter, r *http.Request) {
+	imageRecord, ok := s.getAPIImage(w, r)
+	if !ok {
+		return
+	}
+
+	request := &APIImageRequest{}
+	if !readJSON(w, r, request) {
+		return
+	}
+
+	if request.Description != nil {
+		imageRecord.Description = nilString(*request.Description)
+	}
+
+	err := s.ImageManager.updateImage(imageRecord.ID, imageRecord)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	s.writeAPIImage(w, r, imageRecord.ID)
+}
+
+func (s *AdminServer) handleAPIImageDelete(w http.ResponseWriter, r *http.Request) {
+	imageRecord, ok := s.getAPIImage(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.ImageManager.deleteImage(imageRecord.ID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) handleAPIImageRotate(w http.ResponseWriter, r *http.Request) {
+	imageRecord, ok := s.getAPIImage(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.ImageManager.rotateImage(imageRecord.ID)
+	if err == errImageProcessing {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	s.writeAPIImage(w, r, imageRecord.ID)
+}
+
+func (s *AdminServer) getAPIAlbum(w http.ResponseWriter, r *http.Request) (*AlbumRecord, bool) {
+	albumRecord, err := s.AlbumManager.getAlbum(mux.Vars(r)["albumID"])
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return nil, false
+	}
+	if albumRecord == nil {
+		writeAPIError(w, http.StatusNotFound, "Album not found")
+		return nil, false
+	}
+
+	return albumRecord, true
+}
+
+func (s *AdminServer) getAPIImage(w http.ResponseWriter, r *http.Request) (*ImageRecord, bool) {
+	imageRecord, err := s.ImageManager.getImage(mux.Vars(r)["imageID"])
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return nil, false
+	}
+	if imageRecord == nil {
+		writeAPIError(w, http.StatusNotFound, "Image not found")
+		return nil, false
+	}
+
+	return imageRecord, true
+}
+
+func (s *AdminServer) checkAPICoverPhoto(w http.ResponseWriter, r *http.Request, albumID string, imageID string) bool {
+	isAlbumImage, err := s.ImageManager.isAlbumImage(albumID, imageID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return false
+	}
+	if !isAlbumImage {
+		writeAPIError(w, http.StatusBadRequest, errCoverPhotoNotInAlbum.Error())
+		return false
+	}
+
+	return true
+}
+
+func (s *AdminServer) writeAPIAlbum(w http.ResponseWriter, r *http.Request, albumID string) {
+	albumRecord, err := s.AlbumManager.getAlbum(albumID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIAlbum(albumRecord))
+}
+
+func (s *AdminServer) writeAPIImage(w http.ResponseWriter, r *http.Request, imageID string) {
+	imageRecord, err := s.ImageManager.getImage(imageID)
+	if err != nil {
+		writeAPIServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIImage(imageRecord))
+}
+
+func newAPIAlbum(record *AlbumRecord) *APIAlbum {
+	return &APIAlbum{
+		ID:           record.ID,
+		Title:        record.Title,
+		Description:  record.Description,
+		CoverPhotoID: record.CoverPhotoID,
+		Created:      record.Created,
+	}
+}
+
+func newAPIImage(record *ImageRecord) *APIImage {
+	renditions := make([]*APIRendition, len(record.Renditions))
+	for i, rendition := range record.Renditions {
+		renditions[i] = &APIRendition{
+			Size:   rendition.Size,
+			Width:  rendition.Width,
+			Height: rendition.Height,
+			URL:    rendition.URL(),
+		}
+
+		if rendition.WebPPath != nil {
+			webpURL := getImageURL(*rendition.WebPPath)
+			renditions[i].WebPURL = &webpURL
+		}
+	}
+
+	return &APIImage{
+		ID:           record.ID,
+		AlbumID:      record.AlbumID,
+		Title:        record.Title,
+		Description:  record.Description,
+		FileType:     record.FileType,
+		Size:         record.Size,
+		SHA256:       record.SHA256,
+		Status:       record.Status,
+		Width:        record.Width,
+		Height:       record.Height,
+		Rotation:     record.Rotation,
+		Created:      record.Created,
+		Metadata:     record.Metadata,
+		OriginalURL:  "/image/" + record.ID + "/original",
+		ThumbnailURL: getImageURL(getThumbnailFilePath(record.Path)),
+		Renditions:   renditions,
+	}
+}
+
+func newAPIImageList(records []*ImageRecord) *APIImageList {
+	images := make([]*APIImage, len(records))
+	for i, record := range records {
+		images[i] = newAPIImage(record)
+	}
+
+	return &APIImageList{Images: images}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIServerError logs err and returns a JSON error that doesn't expose
+// it.
+func writeAPIServerError(w http.ResponseWriter, r *http.Request, err error) {
+	getLogger(r).Error("Request failed", "error", err, "path", r.URL.Path)
+	writeAPIError(w, http.StatusInternalServerError, getServerErrorMessage(r))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &APIErrorResponse{
+		Error: &APIError{
+			Status:  status,
+			Message: message,
+		},
+	})
+}
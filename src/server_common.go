@@ -1,25 +1,202 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
+var derivedImagePattern = regexp.MustCompile(`\.(thumb|\d+)\.jpg$`)
+var webpRenditionPattern = regexp.MustCompile(`\.\d+\.webp$`)
+
 func (s *AdminServer) addCommonRoutes() {
-	addCommonRoutes(s.AppState, s.Router)
+	addCommonRoutes(s.AppState, s.Router, "admin")
 }
 
 func (s *PublicServer) addCommonRoutes() {
-	addCommonRoutes(s.AppState, s.Router)
+	addCommonRoutes(s.AppState, s.Router, "public")
 }
 
-func addCommonRoutes(a *AppState, r *(mux.Router)) {
+func addCommonRoutes(a *AppState, r *(mux.Router), server string) {
 	fs := http.FileServer(http.Dir("./www/assets/"))
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", fs))
 
-	ifs := http.FileServer(http.Dir(a.imageDirectoryPath))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", ifs))
+	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler(a.Storage)))
+
+	r.NotFoundHandler = a.Metrics.instrument(server, http.RedirectHandler("/", http.StatusFound), func(r *http.Request) string {
+		return "not_found"
+	})
+}
+
+// imageHandler serves thumbnails and renditions, answering requests for
+// derived JPEG images with their WebP version when the client accepts it.
+// Originals keep all the metadata they were uploaded with, including where
+// they were taken, so they're only downloaded by signed in users from
+// /image/{imageID}/original. Uploads in temp and files the janitor
+// quarantined aren't served either.
+func imageHandler(storage Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Images are served as their extension says, never as whatever the
+		// browser guesses from their bytes.
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		if !isLibraryKey(cleanStorageKey(r.URL.Path)) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if webpRenditionPattern.MatchString(r.URL.Path) {
+			storage.ServeHTTP(w, r)
+			return
+		}
+
+		if !derivedImagePattern.MatchString(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+
+		if acceptsMediaType(r.Header.Get("Accept"), "image/webp") {
+			webpKey := getWebPFilePath(r.URL.Path)
+
+			object, err := storage.Stat(webpKey)
+			if err == nil && object != nil {
+				webpRequest := new(http.Request)
+				*webpRequest = *r
+				webpRequest.URL = new(url.URL)
+				*webpRequest.URL = *r.URL
+				webpRequest.URL.Path = webpKey
+
+				storage.ServeHTTP(w, webpRequest)
+				return
+			}
+		}
+
+		storage.ServeHTTP(w, r)
+	})
+}
+
+func acceptsMediaType(accept string, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		acceptedType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || acceptedType != mediaType {
+			continue
+		}
+
+		if quality, ok := params["q"]; ok {
+			value, err := strconv.ParseFloat(quality, 64)
+			return err == nil && value > 0
+		}
+
+		return true
+	}
+
+	return false
+}
+
+const clientIPContextKey contextKey = "clientIp"
+
+// clientIPMiddleware works out who sent each request. Behind one of the
+// trusted proxies that's the rightmost X-Forwarded-For address no trusted
+// proxy added, otherwise it's the address the connection came from.
+func clientIPMiddleware(trustedProxies []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := getRemoteIP(r)
+
+		if isTrustedProxy(trustedProxies, clientIP) {
+			forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(forwarded) - 1; i >= 0; i-- {
+				address := strings.TrimSpace(forwarded[i])
+				if net.ParseIP(address) == nil {
+					break
+				}
+
+				clientIP = address
+				if !isTrustedProxy(trustedProxies, address) {
+					break
+				}
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPContextKey, clientIP)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getClientIP returns the address clientIPMiddleware settled on for the
+// request.
+func getClientIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return clientIP
+	}
+
+	return getRemoteIP(r)
+}
+
+func getRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func isTrustedProxy(trustedProxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies reads server.trusted_proxies, which validate has
+// already checked.
+func parseTrustedProxies(values []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		network, err := parseTrustedProxy(value)
+		if err == nil {
+			networks = append(networks, network)
+		}
+	}
+
+	return networks
+}
+
+// parseTrustedProxy accepts a CIDR range or a single address.
+func parseTrustedProxy(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address %q", value)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
 
-	r.NotFoundHandler = http.RedirectHandler("/", http.StatusFound)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionOIDCStateKey    = "oidcState"
+	sessionOIDCNonceKey    = "oidcNonce"
+	sessionOIDCVerifierKey = "oidcVerifier"
+	sessionOIDCSinceKey    = "oidcSince"
+
+	// oidcLoginTimeout is how long the user has to finish signing in with
+	// the identity provider.
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// handleOIDCLogin sends the browser to the identity provider. The state,
+// nonce and PKCE verifier wait in a short lived cookie for the callback.
+func (s *AdminServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	session, err := s.OIDCStateStore.Get(r, OIDCStateCookieName)
+	if session == nil && err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	state, err := generateOIDCValue()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	nonce, err := generateOIDCValue()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	authCodeURL, err := s.OIDC.getAuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		getLogger(r).Error("Unable to reach OpenID Connect provider", "error", err)
+		s.renderLoginPage(w, http.StatusBadGateway, &LoginPageData{IsError: true, ErrorMessage: "Single sign-on is unavailable right now"})
+		return
+	}
+
+	session.Values[sessionOIDCStateKey] = state
+	session.Values[sessionOIDCNonceKey] = nonce
+	session.Values[sessionOIDCVerifierKey] = verifier
+	session.Values[sessionOIDCSinceKey] = time.Now().Unix()
+
+	err = session.Save(r, w)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
+}
+
+// handleOIDCCallback finishes sign in when the identity provider sends the
+// browser back with an authorization code.
+func (s *AdminServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	session, err := s.OIDCStateStore.Get(r, OIDCStateCookieName)
+	if session == nil && err != nil {
+		getLogger(r).Warn("Unable to read session", "error", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	state, _ := session.Values[sessionOIDCStateKey].(string)
+	nonce, _ := session.Values[sessionOIDCNonceKey].(string)
+	verifier, _ := session.Values[sessionOIDCVerifierKey].(string)
+	since, _ := session.Values[sessionOIDCSinceKey].(int64)
+
+	// Each state is only good for one callback.
+	session.Options.MaxAge = -1
+
+	err = session.Save(r, w)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if state == "" || time.Since(time.Unix(since, 0)) > oidcLoginTimeout || query.Get("state") != state {
+		s.renderLoginPage(w, http.StatusBadRequest, &LoginPageData{IsError: true, ErrorMessage: "Single sign-on expired, please try again"})
+		return
+	}
+
+	if providerError := query.Get("error"); providerError != "" {
+		getLogger(r).Warn("OpenID Connect provider refused sign in", "error", providerError, "description", query.Get("error_description"))
+		s.renderLoginPage(w, http.StatusUnauthorized, &LoginPageData{IsError: true, ErrorMessage: "Single sign-on was cancelled or refused"})
+		return
+	}
+
+	identity, err := s.OIDC.exchange(query.Get("code"), verifier, nonce)
+	if err != nil {
+		getLogger(r).Warn("Unable to complete OpenID Connect sign in", "error", err)
+		s.renderLoginPage(w, http.StatusUnauthorized, &LoginPageData{IsError: true, ErrorMessage: "Single sign-on failed, please try again"})
+		return
+	}
+
+	user, err := s.OIDC.provisionUser(identity)
+	if err != nil && err != errOIDCNoRole && err != errOIDCUsernameTaken && err != errInvalidCredentials {
+		serverError(w, r, err)
+		return
+	}
+	if err != nil {
+		s.recordLoginAttempt(r, identity.Username, false, loginReasonOIDCRefused)
+		s.renderLoginPage(w, http.StatusForbidden, &LoginPageData{IsError: true, ErrorMessage: err.Error()})
+		return
+	}
+
+	s.recordLoginAttempt(r, user.Username, true, "")
+
+	// The identity provider is responsible for any second factor.
+	s.startSession(w, r, user)
+}
+
+// setLoginOptions fills in which ways of signing in the login page offers.
+func (s *AdminServer) setLoginOptions(data *LoginPageData) {
+	data.OIDCEnabled = s.OIDC.IsEnabled()
+	data.PasswordEnabled = s.OIDC.allowsPasswordLogin()
+}
+
+func (s *AdminServer) renderLoginPage(w http.ResponseWriter, status int, data *LoginPageData) {
+	s.setLoginOptions(data)
+
+	tmpl := template.Must(template.ParseFiles("www/admin/login.html", "www/common_head.html", "www/common_foot.html"))
+
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
+
+func generateOIDCValue() (string, error) {
+	value := make([]byte, 24)
+	_, err := rand.Read(value)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(value), nil
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
 type PublicServer struct {
-	Port         string
+	Address      string
+	Server       *http.Server
 	Router       *mux.Router
 	AppState     *AppState
 	ImageManager *ImageManager
@@ -28,7 +28,7 @@ type PublicAlbumPageData struct {
 
 func newPublicServer(a *AppState) *PublicServer {
 	return &PublicServer{
-		Port:         "80",
+		Address:      a.Config.Server.PublicAddress,
 		Router:       mux.NewRouter(),
 		AppState:     a,
 		ImageManager: a.ImageManager,
@@ -37,25 +37,23 @@ func newPublicServer(a *AppState) *PublicServer {
 }
 
 func (s *PublicServer) startListeningPublic() {
+	s.Router.Use(s.AppState.Metrics.middleware("public"))
+
 	s.Router.HandleFunc("/", s.handleMainPage)
 	s.Router.HandleFunc("/album/{albumID}", s.handleAlbumPage)
 
 	s.addCommonRoutes()
 
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%s", s.Port), s.Router); err != nil {
-			panic(err)
-		}
-		s.AppState.exitCallback <- true
-	}()
+	s.Server = newHTTPServer(s.Address, loggingMiddleware("public", s.Router), &s.AppState.Config.Server)
+	s.AppState.listen(s.Server)
 
-	log.Printf("Public server started on port %s", s.Port)
+	slog.Info("Public server started", "address", s.Address)
 }
 
 func (s *PublicServer) handleMainPage(w http.ResponseWriter, r *http.Request) {
 	albumRecords, err := s.AlbumManager.getAllAlbums()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -74,7 +72,7 @@ func (s *PublicServer) handleAlbumPage(w http.ResponseWriter, r *http.Request) {
 
 	albumRecord, err := s.AlbumManager.getAlbum(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
@@ -85,13 +83,21 @@ func (s *PublicServer) handleAlbumPage(w http.ResponseWriter, r *http.Request) {
 
 	imageRecords, err := s.ImageManager.getAllImagesByAlbumID(albumID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 
+	// Images still being processed have nothing to show yet.
+	readyImageRecords := make([]*ImageRecord, 0, len(imageRecords))
+	for _, imageRecord := range imageRecords {
+		if imageRecord.Status == imageStatusReady {
+			readyImageRecords = append(readyImageRecords, imageRecord)
+		}
+	}
+
 	data := &PublicAlbumPageData{
 		Album:  albumRecord,
-		Images: imageRecords,
+		Images: readyImageRecords,
 	}
 
 	tmpl := template.Must(template.ParseFiles("www/public/public_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/public/album.html", "www/photoswipe.html"))
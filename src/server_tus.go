@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,expiration,termination"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// addTusRoutes serves the tus 1.0 resumable upload protocol, see
+// https://tus.io/protocols/resumable-upload. Uploads are created in an album
+// and become images once all their data has arrived.
+func (s *AdminServer) addTusRoutes() {
+	router := s.Router.PathPrefix("/tus/{albumID}").Subrouter()
+	router.Use(tusMiddleware)
+
+	router.HandleFunc("", handleTusOptions).Methods("OPTIONS")
+	router.Handle("", s.authHandler(RoleUploader, s.handleTusCreate)).Methods("POST")
+	router.Handle("/{uploadID}", s.authHandler(RoleUploader, s.handleTusHead)).Methods("HEAD")
+	router.Handle("/{uploadID}", s.authHandler(RoleUploader, s.handleTusPatch)).Methods("PATCH")
+	router.Handle("/{uploadID}", s.authHandler(RoleUploader, s.handleTusDelete)).Methods("DELETE")
+}
+
+// tusMiddleware checks the client speaks the protocol version the server
+// does. OPTIONS is how a client finds out, so it's always answered.
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusCreate starts an upload of Upload-Length bytes. The file name is
+// sent as filename in Upload-Metadata.
+func (s *AdminServer) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	albumID := mux.Vars(r)["albumID"]
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length isn't supported", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length must be a number of bytes", http.StatusBadRequest)
+		return
+	}
+
+	fileName := filepath.Base(parseTusMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+	if !strings.Contains(strings.Trim(fileName, "."), ".") {
+		http.Error(w, "Upload-Metadata must include a filename with an extension", http.StatusBadRequest)
+		return
+	}
+
+	album, err := s.AlbumManager.getAlbum(albumID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if album == nil {
+		http.Error(w, errAlbumNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	upload, err := s.Tus.createUpload(albumID, getCurrentUser(r).ID, fileName, length)
+	if uploadErr, ok := err.(*UploadError); ok {
+		http.Error(w, uploadErr.Message, uploadErr.Status)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	s.setTusExpires(w, upload)
+	w.Header().Set("Location", fmt.Sprintf("/tus/%s/%s", albumID, upload.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleTusHead reports how much of the upload has arrived. A complete
+// upload is turned into an image first if the request that completed it
+// couldn't, since a client that sees all its data has arrived won't send
+// more. Once the upload is an image, its ID is in Picfolio-Image-ID.
+func (s *AdminServer) handleTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := s.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if upload.isComplete() && !s.finishTusUpload(w, r, upload) {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	s.setTusExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends the request body to the upload. The request that
+// completes the upload also creates the image, and answers with its ID in
+// Picfolio-Image-ID. Repeating that request gets the same answer.
+func (s *AdminServer) handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := s.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset must be a number of bytes", http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > upload.Length-offset {
+		http.Error(w, errTusLengthExceeded.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxRequestSize := s.AppState.Config.Uploads.MaxRequestSize
+	if maxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxRequestSize))
+	}
+
+	err = s.Tus.writeChunk(upload, offset, r.Body)
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case err == errTusOffsetMismatch:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == errTusUploadLocked:
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	case err == errTusUploadNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == errTusLengthExceeded:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &maxBytesError):
+		http.Error(w, newRequestTooLargeError(maxRequestSize).Message, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		// Usually the client went away. What arrived is kept for it to
+		// resume from.
+		getLogger(r).Warn("Resumable upload interrupted", "upload_id", upload.ID, "offset", upload.Offset, "error", err)
+		http.Error(w, "The upload was interrupted", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if !upload.isComplete() {
+		s.setTusExpires(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !s.finishTusUpload(w, r, upload) {
+		return
+	}
+
+	s.setTusExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload turns a complete upload into an image and sets
+// Picfolio-Image-ID, returning false once it has responded with an error.
+func (s *AdminServer) finishTusUpload(w http.ResponseWriter, r *http.Request, upload *TusUpload) bool {
+	imageID, err := s.Tus.finishUpload(upload)
+	if uploadErr, ok := err.(*UploadError); ok {
+		http.Error(w, uploadErr.Message, uploadErr.Status)
+		return false
+	}
+	if err == errAlbumNotFound || err == errTusUploadNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+	if err == errTusUploadLocked {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return false
+	}
+
+	w.Header().Set("Picfolio-Image-ID", imageID)
+	return true
+}
+
+func (s *AdminServer) handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := s.getTusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.Tus.deleteUpload(upload)
+	if err == errTusUploadLocked {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTusUpload finds the upload in the URL, which has to belong to the
+// signed in user and the album in the URL. Other uploads are treated as not
+// existing.
+func (s *AdminServer) getTusUpload(w http.ResponseWriter, r *http.Request) (*TusUpload, bool) {
+	vars := mux.Vars(r)
+
+	upload, err := s.Tus.getUpload(vars["uploadID"])
+	if err == nil && (upload.AlbumID != vars["albumID"] || upload.UserID != getCurrentUser(r).ID) {
+		err = errTusUploadNotFound
+	}
+	if err == errTusUploadNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+
+	return upload, true
+}
+
+func (s *AdminServer) setTusExpires(w http.ResponseWriter, upload *TusUpload) {
+	if expires, ok := s.Tus.getExpiry(upload); ok {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// parseTusMetadata reads Upload-Metadata, a comma separated list of keys
+// each followed by a space and a base64 value. Values that don't decode are
+// left out.
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+
+		if len(parts) == 1 {
+			metadata[parts[0]] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		metadata[parts[0]] = string(value)
+	}
+
+	return metadata
+}
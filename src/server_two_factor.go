@@ -0,0 +1,312 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	sessionPendingUserIDKey     = "pendingUserId"
+	sessionPendingSinceKey      = "pendingSince"
+	sessionPendingTOTPSecretKey = "pendingTotpSecret"
+
+	// twoFactorLoginTimeout is how long the code step waits after the
+	// password step before the user has to start over.
+	twoFactorLoginTimeout = 5 * time.Minute
+)
+
+type SecurityPageData struct {
+	AdminPage
+	Enabled                bool
+	RemainingRecoveryCodes int
+	PendingSecret          string
+	ProvisioningURI        string
+	RecoveryCodes          []string
+	IsError                bool
+	ErrorMessage           string
+}
+
+// startTwoFactorLogin remembers who passed the password step and asks for
+// their code. The session isn't signed in until the code checks out.
+func (s *AdminServer) startTwoFactorLogin(w http.ResponseWriter, r *http.Request, user *UserRecord) bool {
+	session, err := s.SessionStore.Get(r, SessionCookieName)
+	if session == nil && err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	err = s.SessionManager.renewSession(session)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	session.Options.MaxAge = int(twoFactorLoginTimeout / time.Second)
+	session.Values[sessionPendingUserIDKey] = user.ID
+	session.Values[sessionPendingSinceKey] = time.Now().Unix()
+	setCSRFToken(session)
+
+	err = session.Save(r, w)
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+	return true
+}
+
+func (s *AdminServer) handleLoginTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionStore.Get(r, SessionCookieName)
+	if session == nil && err != nil {
+		getLogger(r).Warn("Unable to read session", "error", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := s.getPendingTwoFactorUser(session.Values)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	csrfToken, _ := session.Values[sessionCSRFTokenKey].(string)
+	data := &LoginPageData{CSRFToken: csrfToken}
+
+	if r.Method == "POST" && s.handleLoginTwoFactor(w, r, user, data) {
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("www/admin/login_2fa.html", "www/common_head.html", "www/common_foot.html"))
+
+	tmpl.Execute(w, data)
+}
+
+// handleLoginTwoFactor checks the code from the second login step, returning
+// true once it has responded. Wrong codes count towards the login throttle.
+func (s *AdminServer) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request, user *UserRecord, data *LoginPageData) bool {
+	status, err := s.LoginThrottle.check(user.Username, getClientIP(r))
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	if status.RetryAfter > 0 {
+		s.recordLoginAttempt(r, user.Username, false, loginReasonThrottled)
+
+		w.Header().Set("Retry-After", strconv.Itoa(int((status.RetryAfter+time.Second-1)/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		data.IsError = true
+		data.IsLockedOut = status.LockedOut
+		data.ErrorMessage = status.Message()
+		return false
+	}
+
+	err = s.TwoFactor.verify(user, r.FormValue("code"))
+	if err == errInvalidTwoFactorCode {
+		s.recordLoginAttempt(r, user.Username, false, loginReasonInvalidCode)
+
+		w.WriteHeader(http.StatusUnauthorized)
+		data.IsError = true
+		data.ErrorMessage = err.Error()
+		return false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return true
+	}
+
+	s.recordLoginAttempt(r, user.Username, true, "")
+
+	return s.startSession(w, r, user)
+}
+
+// getPendingTwoFactorUser returns the user waiting on the code step, or nil
+// when there isn't one or they took too long.
+func (s *AdminServer) getPendingTwoFactorUser(values map[interface{}]interface{}) (*UserRecord, error) {
+	userID, _ := values[sessionPendingUserIDKey].(string)
+	since, _ := values[sessionPendingSinceKey].(int64)
+	if userID == "" || time.Since(time.Unix(since, 0)) > twoFactorLoginTimeout {
+		return nil, nil
+	}
+
+	user, err := s.UserManager.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled || !user.HasTwoFactor() {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func (s *AdminServer) handleSecurityPage(w http.ResponseWriter, r *http.Request) {
+	s.renderSecurityPage(w, r, http.StatusOK, &SecurityPageData{})
+}
+
+func (s *AdminServer) handleSecurityQRCode(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	session, _ := s.SessionStore.Get(r, SessionCookieName)
+	secret, _ := session.Values[sessionPendingTOTPSecretKey].(string)
+	if secret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	png, err := qrcode.Encode(s.TwoFactor.getProvisioningURI(getCurrentUser(r), secret), qrcode.Medium, 256)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+func (s *AdminServer) handleTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	session, _ := s.SessionStore.Get(r, SessionCookieName)
+	secret, _ := session.Values[sessionPendingTOTPSecretKey].(string)
+	if secret == "" {
+		http.Redirect(w, r, "/account/security", http.StatusFound)
+		return
+	}
+
+	data := &SecurityPageData{}
+
+	codes, err := s.TwoFactor.enable(getCurrentUser(r), secret, r.FormValue("code"))
+	if err == errInvalidTwoFactorCode {
+		data.IsError = true
+		data.ErrorMessage = err.Error()
+		s.renderSecurityPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	delete(session.Values, sessionPendingTOTPSecretKey)
+	err = session.Save(r, w)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	data.RecoveryCodes = codes
+	s.renderSecurityPage(w, r, http.StatusOK, data)
+}
+
+func (s *AdminServer) handleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	err := s.TwoFactor.disable(getCurrentUser(r), r.FormValue("code"))
+	if err == errInvalidTwoFactorCode || err == errTwoFactorNotEnabled {
+		s.renderSecurityPage(w, r, http.StatusBadRequest, &SecurityPageData{IsError: true, ErrorMessage: err.Error()})
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/account/security", http.StatusFound)
+}
+
+func (s *AdminServer) handleRecoveryCodesRegenerate(w http.ResponseWriter, r *http.Request) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	err := s.TwoFactor.verify(user, r.FormValue("code"))
+	if err == errInvalidTwoFactorCode || err == errTwoFactorNotEnabled {
+		s.renderSecurityPage(w, r, http.StatusBadRequest, &SecurityPageData{IsError: true, ErrorMessage: err.Error()})
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	codes, err := s.TwoFactor.regenerateRecoveryCodes(user)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	s.renderSecurityPage(w, r, http.StatusOK, &SecurityPageData{RecoveryCodes: codes})
+}
+
+// renderSecurityPage shows the two-factor settings. Users without a second
+// factor get a pending secret, kept in their session until they confirm it.
+func (s *AdminServer) renderSecurityPage(w http.ResponseWriter, r *http.Request, status int, data *SecurityPageData) {
+	if !checkSessionOnly(w, r) {
+		return
+	}
+
+	data.AdminPage = newAdminPage(r)
+
+	// Reload so the page reflects a change made by this request.
+	user, err := s.UserManager.getUser(data.CurrentUser.ID)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	data.Enabled = user.HasTwoFactor()
+
+	if data.Enabled {
+		data.RemainingRecoveryCodes, err = s.TwoFactor.getUnusedRecoveryCodeCount(user)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	} else {
+		session, _ := s.SessionStore.Get(r, SessionCookieName)
+		secret, _ := session.Values[sessionPendingTOTPSecretKey].(string)
+
+		if secret == "" {
+			secret, err = generateTOTPSecret()
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+
+			session.Values[sessionPendingTOTPSecretKey] = secret
+			err = session.Save(r, w)
+			if err != nil {
+				serverError(w, r, err)
+				return
+			}
+		}
+
+		data.PendingSecret = secret
+		data.ProvisioningURI = s.TwoFactor.getProvisioningURI(user, secret)
+	}
+
+	tmpl := template.Must(template.ParseFiles("www/admin/admin_wrapper.html", "www/common_head.html", "www/common_foot.html", "www/admin/security.html"))
+
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionKeyRetention is how many key pairs are kept after a rotation. The
+// newest signs new cookies and the older ones keep existing cookies valid.
+const sessionKeyRetention = 3
+
+const (
+	sessionStoreCookie = "cookie"
+	sessionStoreSQLite = "sqlite"
+)
+
+var errSessionNotFound = errors.New("Session not found")
+
+type SessionManager struct {
+	AppState   *AppState
+	Repository *Repository
+	StoreType  string
+}
+
+func newSessionManager(a *AppState) *SessionManager {
+	return &SessionManager{
+		AppState:   a,
+		Repository: a.Repository,
+		StoreType:  strings.ToLower(a.Config.Sessions.Store),
+	}
+}
+
+// newSessionStore builds the configured admin session store, signing
+// and encrypting cookies with the configured or persisted keys.
+func (m *SessionManager) newSessionStore() (sessions.Store, error) {
+	keyPairs, err := m.getKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   SessionDuration,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	switch m.StoreType {
+	case sessionStoreCookie:
+		store := sessions.NewCookieStore(keyPairs...)
+		store.Options = options
+		return store, nil
+	case sessionStoreSQLite:
+		err = m.deleteExpiredSessions(time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		return newSQLiteSessionStore(m.Repository, options, keyPairs...), nil
+	}
+
+	return nil, fmt.Errorf("Unknown session store %q, expected cookie or sqlite", m.StoreType)
+}
+
+// newOIDCStateStore builds the store that holds single sign-on state until
+// the identity provider sends the browser back. It's always a short lived
+// cookie, so visitors who never finish signing in leave nothing behind on
+// the server.
+func (m *SessionManager) newOIDCStateStore() (sessions.Store, error) {
+	keyPairs, err := m.getKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = &sessions.Options{
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return store, nil
+}
+
+// deleteExpiredSessions removes server-side sessions past their expiry.
+func (m *SessionManager) deleteExpiredSessions(now time.Time) error {
+	if !m.IsServerSide() {
+		return nil
+	}
+
+	return m.Repository.deleteExpiredSessionRecords(now)
+}
+
+// hasConfiguredKeys reports whether keys come from the configuration rather
+// than the database.
+func (m *SessionManager) hasConfiguredKeys() bool {
+	return m.AppState.Config.Sessions.Keys != ""
+}
+
+func (m *SessionManager) IsServerSide() bool {
+	return m.StoreType == sessionStoreSQLite
+}
+
+// getKeyPairs returns hash and block key pairs, newest first. Configured
+// keys take precedence over keys persisted in the database, which are
+// created on first use.
+func (m *SessionManager) getKeyPairs() ([][]byte, error) {
+	if m.hasConfiguredKeys() {
+		return parseSessionKeys(m.AppState.Config.Sessions.Keys)
+	}
+
+	records, err := m.Repository.getSessionKeyRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		record, err := m.rotateKeys()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	keyPairs := make([][]byte, 0, len(records)*2)
+	for _, record := range records {
+		keyPairs = append(keyPairs, record.HashKey, record.BlockKey)
+	}
+
+	return keyPairs, nil
+}
+
+// rotateKeys adds a new persisted key pair and drops pairs past the
+// retention limit. Restart the server to start signing with the new pair.
+func (m *SessionManager) rotateKeys() (*SessionKeyRecord, error) {
+	record := &SessionKeyRecord{
+		ID:       m.AppState.generateID(),
+		HashKey:  securecookie.GenerateRandomKey(64),
+		BlockKey: securecookie.GenerateRandomKey(32),
+		Created:  time.Now().UTC(),
+	}
+
+	err := m.Repository.createSessionKeyRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := m.Repository.getSessionKeyRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := sessionKeyRetention; i < len(records); i++ {
+		err = m.Repository.deleteSessionKeyRecord(records[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// getActiveSessions lists the sessions a user may see. Owners see everyone's.
+func (m *SessionManager) getActiveSessions(user *UserRecord) ([]*SessionRecord, error) {
+	userID := user.ID
+	if user.IsOwner() {
+		userID = ""
+	}
+
+	return m.Repository.getActiveSessionRecords(userID, time.Now().UTC())
+}
+
+func (m *SessionManager) revokeSession(user *UserRecord, sessionID string) error {
+	record, err := m.Repository.getSessionRecord(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if record == nil || record.UserID == nil || (*record.UserID != user.ID && !user.IsOwner()) {
+		return errSessionNotFound
+	}
+
+	return m.Repository.deleteSessionRecord(sessionID)
+}
+
+func (m *SessionManager) revokeUserSessions(userID string) error {
+	return m.Repository.deleteSessionRecordsByUserID(userID)
+}
+
+// renewSession drops a server-side session before sign in so the signed in
+// session gets a fresh ID.
+func (m *SessionManager) renewSession(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+
+	err := m.Repository.deleteSessionRecord(session.ID)
+	if err != nil {
+		return err
+	}
+
+	session.ID = ""
+	return nil
+}
+
+// parseSessionKeys reads comma separated base64 "hashKey:blockKey" pairs,
+// newest first.
+func parseSessionKeys(value string) ([][]byte, error) {
+	keyPairs := [][]byte{}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("SESSION_KEYS entries must be base64 hashKey:blockKey pairs")
+		}
+
+		hashKey, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil || len(hashKey) < 32 {
+			return nil, fmt.Errorf("SESSION_KEYS hash keys must be base64 encoded and at least 32 bytes")
+		}
+
+		blockKey, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || (len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32) {
+			return nil, fmt.Errorf("SESSION_KEYS block keys must be base64 encoded and 16, 24 or 32 bytes")
+		}
+
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+
+	return keyPairs, nil
+}
+
+// Device summarises the session's user agent for the sessions page.
+func (s *SessionRecord) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+
+	return browser
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// lastSeenResolution limits how often reading a session writes its last seen
+// timestamp.
+const lastSeenResolution = time.Minute
+
+// SQLiteSessionStore keeps session values in the database and only a signed
+// session ID in the cookie, so sessions can be listed and revoked.
+type SQLiteSessionStore struct {
+	Codecs     []securecookie.Codec
+	Options    *sessions.Options
+	Repository *Repository
+	serializer securecookie.GobEncoder
+}
+
+func newSQLiteSessionStore(repository *Repository, options *sessions.Options, keyPairs ...[]byte) *SQLiteSessionStore {
+	return &SQLiteSessionStore{
+		Codecs:     securecookie.CodecsFromPairs(keyPairs...),
+		Options:    options,
+		Repository: repository,
+	}
+}
+
+func (s *SQLiteSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *SQLiteSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var sessionID string
+	err = securecookie.DecodeMulti(name, cookie.Value, &sessionID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	record, err := s.Repository.getSessionRecord(sessionID)
+	if err != nil {
+		return session, err
+	}
+
+	now := time.Now().UTC()
+	if record == nil || !now.Before(record.Expires) {
+		return session, nil
+	}
+
+	err = s.serializer.Deserialize(record.Data, &session.Values)
+	if err != nil {
+		return session, err
+	}
+
+	session.ID = record.ID
+	session.IsNew = false
+
+	ipAddress := getClientIP(r)
+	if now.Sub(record.LastSeen) >= lastSeenResolution || ipAddress != record.IPAddress {
+		err = s.Repository.updateSessionLastSeen(record.ID, now, ipAddress)
+		if err != nil {
+			return session, err
+		}
+	}
+
+	return session, nil
+}
+
+func (s *SQLiteSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.Repository.deleteSessionRecord(session.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	if session.ID == "" {
+		session.ID = generateSessionID()
+	}
+
+	data, err := s.serializer.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	var userID *string
+	if value, ok := session.Values[sessionUserIDKey].(string); ok && value != "" {
+		userID = &value
+	}
+
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = SessionDuration
+	}
+
+	err = s.Repository.saveSessionRecord(&SessionRecord{
+		ID:        session.ID,
+		UserID:    userID,
+		Data:      data,
+		UserAgent: r.UserAgent(),
+		IPAddress: getClientIP(r),
+		Created:   now,
+		LastSeen:  now,
+		Expires:   now.Add(time.Duration(maxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func generateSessionID() string {
+	encoded := base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	return strings.TrimRight(encoded, "=")
+}
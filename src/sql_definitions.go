@@ -24,6 +24,149 @@ CREATE TABLE IF NOT EXISTS albums (
 );
 `
 
+const imageMetadataSQL = `
+ALTER TABLE images ADD COLUMN captured TIMESTAMP;
+ALTER TABLE images ADD COLUMN cameraMake TEXT;
+ALTER TABLE images ADD COLUMN cameraModel TEXT;
+ALTER TABLE images ADD COLUMN lensModel TEXT;
+ALTER TABLE images ADD COLUMN exposureTime TEXT;
+ALTER TABLE images ADD COLUMN fNumber REAL;
+ALTER TABLE images ADD COLUMN focalLength REAL;
+ALTER TABLE images ADD COLUMN iso INT;
+ALTER TABLE images ADD COLUMN latitude REAL;
+ALTER TABLE images ADD COLUMN longitude REAL;
+ALTER TABLE images ADD COLUMN headline TEXT;
+ALTER TABLE images ADD COLUMN caption TEXT;
+ALTER TABLE images ADD COLUMN creator TEXT;
+ALTER TABLE images ADD COLUMN copyright TEXT;
+ALTER TABLE images ADD COLUMN keywords TEXT;
+`
+
+const imageRotationSQL = `
+ALTER TABLE images ADD COLUMN rotation INT NOT NULL DEFAULT 0;
+`
+
+const renditionsSQL = `
+CREATE TABLE IF NOT EXISTS renditions (
+	imageId TEXT NOT NULL,
+	size INT NOT NULL,
+	path TEXT,
+	width INT,
+	height INT,
+	bytes INT64,
+	created TIMESTAMP,
+	PRIMARY KEY (imageId, size)
+);
+`
+
+const renditionsWebPSQL = `
+ALTER TABLE renditions ADD COLUMN webpPath TEXT;
+ALTER TABLE renditions ADD COLUMN webpBytes INT64;
+`
+
+const usersSQL = `
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT NOT NULL PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+	passwordHash TEXT,
+	role TEXT NOT NULL,
+	disabled INT NOT NULL DEFAULT 0,
+	created TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS albumPermissions (
+	userId TEXT NOT NULL,
+	albumId TEXT NOT NULL,
+	role TEXT NOT NULL,
+	PRIMARY KEY (userId, albumId)
+);
+`
+
+const apiTokensSQL = `
+CREATE TABLE IF NOT EXISTS apiTokens (
+	id TEXT NOT NULL PRIMARY KEY,
+	userId TEXT NOT NULL,
+	name TEXT NOT NULL,
+	tokenHash TEXT NOT NULL UNIQUE,
+	expires TIMESTAMP,
+	lastUsed TIMESTAMP,
+	created TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS apiTokensUserId ON apiTokens (userId);
+`
+
+const sessionsSQL = `
+CREATE TABLE IF NOT EXISTS sessionKeys (
+	id TEXT NOT NULL PRIMARY KEY,
+	hashKey BLOB NOT NULL,
+	blockKey BLOB NOT NULL,
+	created TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT NOT NULL PRIMARY KEY,
+	userId TEXT,
+	data BLOB,
+	userAgent TEXT,
+	ipAddress TEXT,
+	created TIMESTAMP,
+	lastSeen TIMESTAMP,
+	expires TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessionsUserId ON sessions (userId);
+`
+
+const loginAttemptsSQL = `
+CREATE TABLE IF NOT EXISTS loginAttempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL COLLATE NOCASE,
+	ipAddress TEXT NOT NULL,
+	success INT NOT NULL,
+	reason TEXT,
+	userAgent TEXT,
+	created TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS loginAttemptsUsername ON loginAttempts (username, created);
+CREATE INDEX IF NOT EXISTS loginAttemptsIPAddress ON loginAttempts (ipAddress, created);
+`
+
+const twoFactorSQL = `
+ALTER TABLE users ADD COLUMN totpSecret TEXT;
+ALTER TABLE users ADD COLUMN totpLastCounter INTEGER;
+CREATE TABLE IF NOT EXISTS recoveryCodes (
+	userId TEXT NOT NULL,
+	codeHash TEXT NOT NULL,
+	used TIMESTAMP,
+	created TIMESTAMP,
+	PRIMARY KEY (userId, codeHash)
+);
+`
+
+const oidcSQL = `
+ALTER TABLE users ADD COLUMN oidcIssuer TEXT;
+ALTER TABLE users ADD COLUMN oidcSubject TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS usersOIDCSubject ON users (oidcIssuer, oidcSubject);
+`
+
+const imageSHA256SQL = `
+ALTER TABLE images ADD COLUMN sha256 TEXT;
+`
+
+const jobsSQL = `
+ALTER TABLE images ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	kind TEXT NOT NULL,
+	imageId TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	error TEXT,
+	runAfter TIMESTAMP NOT NULL,
+	created TIMESTAMP NOT NULL,
+	updated TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS jobsStatus ON jobs (status, runAfter);
+CREATE INDEX IF NOT EXISTS jobsImageId ON jobs (imageId);
+`
+
 type ImageRecord struct {
 	ID          string
 	FileType    *string
@@ -31,10 +174,39 @@ type ImageRecord struct {
 	Title       *string
 	Description *string
 	Size        int64
+	SHA256      *string
+	Status      string
 	AlbumID     string
 	Height      int
 	Width       int
 	Created     time.Time
+	Rotation    int
+	Metadata    ImageMetadata
+	Renditions  []*RenditionRecord
+}
+
+type JobRecord struct {
+	ID       string
+	Kind     string
+	ImageID  string
+	Status   string
+	Attempts int
+	Error    *string
+	RunAfter time.Time
+	Created  time.Time
+	Updated  time.Time
+}
+
+type RenditionRecord struct {
+	ImageID   string
+	Size      int
+	Path      string
+	Width     int
+	Height    int
+	Bytes     int64
+	WebPPath  *string
+	WebPBytes *int64
+	Created   time.Time
 }
 
 type AlbumRecord struct {
@@ -44,3 +216,64 @@ type AlbumRecord struct {
 	CoverPhotoID *string
 	Created      time.Time
 }
+
+type UserRecord struct {
+	ID               string
+	Username         string
+	PasswordHash     *string
+	Role             Role
+	Disabled         bool
+	Created          time.Time
+	TOTPSecret       *string
+	TOTPLastCounter  *int64
+	OIDCIssuer       *string
+	OIDCSubject      *string
+	AlbumPermissions map[string]Role
+}
+
+type APITokenRecord struct {
+	ID        string
+	UserID    string
+	Name      string
+	TokenHash string
+	Expires   *time.Time
+	LastUsed  *time.Time
+	Created   time.Time
+}
+
+type SessionKeyRecord struct {
+	ID       string
+	HashKey  []byte
+	BlockKey []byte
+	Created  time.Time
+}
+
+type SessionRecord struct {
+	ID        string
+	UserID    *string
+	Data      []byte
+	UserAgent string
+	IPAddress string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	Username  *string
+}
+
+type LoginAttemptRecord struct {
+	ID        int64
+	Username  string
+	IPAddress string
+	Success   bool
+	Reason    *string
+	UserAgent string
+	Created   time.Time
+}
+
+type LibraryTotals struct {
+	Albums         int
+	Images         int
+	OriginalBytes  int64
+	RenditionBytes int64
+	WebPBytes      int64
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	storageBackendFileSystem = "filesystem"
+	storageBackendS3         = "s3"
+)
+
+// Storage is the backend that holds original images and their derived files.
+// Keys are slash separated and relative to the backend root, for example
+// "<albumID>/<imageID>.jpg". ServeHTTP serves the object named by the request
+// path, so backends are mounted behind http.StripPrefix.
+type Storage interface {
+	Put(key string, reader io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (*StorageObject, error)
+	Delete(key string) error
+	List(prefix string) ([]*StorageObject, error)
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+}
+
+type StorageObject struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+func newStorage(config *StorageConfig, imageDirectoryPath string) (Storage, error) {
+	switch config.Backend {
+	case storageBackendFileSystem:
+		return newFileSystemStorage(imageDirectoryPath), nil
+	case storageBackendS3:
+		return newS3Storage(&S3StorageOptions{
+			Endpoint:        config.S3.Endpoint,
+			AccessKeyID:     config.S3.AccessKeyID,
+			SecretAccessKey: config.S3.SecretAccessKey,
+			Bucket:          config.S3.Bucket,
+			Region:          config.S3.Region,
+			UseSSL:          config.S3.UseSSL,
+		})
+	}
+
+	return nil, fmt.Errorf("Unknown storage backend %q", config.Backend)
+}
+
+func putStorageFile(storage Storage, sourcePath string, key string) error {
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(key, file, info.Size(), getContentType(key))
+}
+
+func getStorageFile(storage Storage, key string, destinationPath string) error {
+	reader, err := storage.Get(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(destinationPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func deleteStoragePrefix(storage Storage, prefix string) error {
+	objects, err := storage.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		err = storage.Delete(object.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getContentType(key string) string {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+func cleanStorageKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSystemStorage keeps objects as plain files below a root directory.
+type FileSystemStorage struct {
+	Root       string
+	fileServer http.Handler
+}
+
+func newFileSystemStorage(root string) *FileSystemStorage {
+	return &FileSystemStorage{
+		Root:       root,
+		fileServer: http.FileServer(http.Dir(root)),
+	}
+}
+
+func (s *FileSystemStorage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	filePath := s.getFilePath(key)
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tempFile, reader)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	err = os.Chmod(tempFile.Name(), 0644)
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), filePath)
+}
+
+func (s *FileSystemStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.getFilePath(key))
+}
+
+func (s *FileSystemStorage) Stat(key string) (*StorageObject, error) {
+	info, err := os.Stat(s.getFilePath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &StorageObject{
+		Key:      cleanStorageKey(key),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	}, nil
+}
+
+func (s *FileSystemStorage) Delete(key string) error {
+	filePath := s.getFilePath(key)
+
+	err := os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Prune directories left empty, such as the folder of a deleted album.
+	for dir := filepath.Dir(filePath); dir != s.Root && strings.HasPrefix(dir, s.Root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *FileSystemStorage) List(prefix string) ([]*StorageObject, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	walkRoot := filepath.Dir(s.getFilePath(prefix + "_"))
+
+	objects := make([]*StorageObject, 0)
+
+	err := filepath.Walk(walkRoot, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.Root, filePath)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		objects = append(objects, &StorageObject{
+			Key:      key,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (s *FileSystemStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.fileServer.ServeHTTP(w, r)
+}
+
+func (s *FileSystemStorage) getFilePath(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(cleanStorageKey(key)))
+}
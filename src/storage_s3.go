@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go"
+)
+
+// S3Storage keeps objects in a bucket of an S3 compatible object store, such
+// as AWS S3 or a MinIO server.
+type S3Storage struct {
+	Client *minio.Client
+	Bucket string
+}
+
+type S3StorageOptions struct {
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	Bucket          string
+	Region          string
+	UseSSL          bool
+}
+
+func newS3Storage(options *S3StorageOptions) (*S3Storage, error) {
+	if options.Endpoint == "" || options.Bucket == "" {
+		return nil, fmt.Errorf("S3 storage requires an endpoint and a bucket")
+	}
+
+	client, err := minio.NewWithRegion(options.Endpoint, options.AccessKeyID, options.SecretAccessKey, options.UseSSL, options.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(options.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		err = client.MakeBucket(options.Bucket, options.Region)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3Storage{
+		Client: client,
+		Bucket: options.Bucket,
+	}, nil
+}
+
+func (s *S3Storage) Put(key string, reader io.Reader, size int64, contentType string) error {
+	_, err := s.Client.PutObject(s.Bucket, cleanStorageKey(key), reader, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	object, err := s.Client.GetObject(s.Bucket, cleanStorageKey(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, stat the object so a missing key fails here.
+	_, err = object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (s *S3Storage) Stat(key string) (*StorageObject, error) {
+	info, err := s.Client.StatObject(s.Bucket, cleanStorageKey(key), minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &StorageObject{
+		Key:      info.Key,
+		Size:     info.Size,
+		Modified: info.LastModified,
+	}, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return s.Client.RemoveObject(s.Bucket, cleanStorageKey(key))
+}
+
+func (s *S3Storage) List(prefix string) ([]*StorageObject, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	objects := make([]*StorageObject, 0)
+
+	for info := range s.Client.ListObjectsV2(s.Bucket, strings.TrimPrefix(prefix, "/"), true, doneCh) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+
+		objects = append(objects, &StorageObject{
+			Key:      info.Key,
+			Size:     info.Size,
+			Modified: info.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *S3Storage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	object, err := s.Client.GetObject(s.Bucket, cleanStorageKey(r.URL.Path), minio.GetObjectOptions{})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		if isS3NotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		serverError(w, r, err)
+		return
+	}
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+
+	http.ServeContent(w, r, info.Key, info.LastModified, object)
+}
+
+func isS3NotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testS3Bucket = "picfolio"
+
+type testS3Object struct {
+	Data        []byte
+	ContentType string
+	Modified    time.Time
+}
+
+// testS3Server is just enough of a MinIO server for S3Storage: path style
+// buckets, objects uploaded with streaming signatures and V2 listings.
+type testS3Server struct {
+	Server *httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*testS3Object
+}
+
+func newTestS3Server(t *testing.T) *testS3Server {
+	t.Helper()
+
+	s := &testS3Server{buckets: make(map[string]map[string]*testS3Object)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Server.Close)
+
+	return s
+}
+
+func (s *testS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketName, key := r.URL.Path[1:], ""
+	if index := strings.Index(bucketName, "/"); index >= 0 {
+		bucketName, key = bucketName[:index], bucketName[index+1:]
+	}
+
+	bucket, exists := s.buckets[bucketName]
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			if !exists {
+				s.buckets[bucketName] = make(map[string]*testS3Object)
+			}
+		case !exists:
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			s.list(w, bucket, r.URL.Query().Get("prefix"))
+		}
+		return
+	}
+
+	if !exists {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		bucket[key] = &testS3Object{Data: data, ContentType: r.Header.Get("Content-Type"), Modified: time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+	case http.MethodGet, http.MethodHead:
+		object, ok := bucket[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.ContentType)
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(object.Data))+`"`)
+		http.ServeContent(w, r, key, object.Modified, bytes.NewReader(object.Data))
+	case http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *testS3Server) list(w http.ResponseWriter, bucket map[string]*testS3Object, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: testS3Bucket, Prefix: prefix}
+
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		object := bucket[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: object.Modified.Format(time.RFC3339),
+			ETag:         `"` + strconv.Itoa(len(object.Data)) + `"`,
+			Size:         int64(len(object.Data)),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Body reads an upload, undoing the chunked encoding minio-go uses for
+// streaming signatures over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	reader := bufio.NewReader(r.Body)
+	data := make([]byte, 0)
+
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func newTestS3Storage(t *testing.T) (*S3Storage, *testS3Server) {
+	t.Helper()
+
+	server := newTestS3Server(t)
+
+	storage, err := newS3Storage(&S3StorageOptions{
+		Endpoint:        strings.TrimPrefix(server.Server.URL, "http://"),
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Bucket:          testS3Bucket,
+		Region:          "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("newS3Storage: %v", err)
+	}
+
+	return storage, server
+}
+
+func TestS3StorageCreatesBucket(t *testing.T) {
+	_, server := newTestS3Storage(t)
+
+	if _, ok := server.buckets[testS3Bucket]; !ok {
+		t.Errorf("bucket %s wasn't created", testS3Bucket)
+	}
+}
+
+func TestS3StorageObjects(t *testing.T) {
+	storage, _ := newTestS3Storage(t)
+
+	put := func(key string, data string) {
+		t.Helper()
+		err := storage.Put(key, strings.NewReader(data), int64(len(data)), "image/jpeg")
+		if err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	put("/album/image.jpg", "original")
+	put("album/image.thumb.jpg", "thumb")
+	put("other/image.jpg", "other")
+
+	object, err := storage.Stat("album/image.jpg")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if object == nil || object.Key != "album/image.jpg" || object.Size != int64(len("original")) || object.Modified.IsZero() {
+		t.Errorf("Stat = %+v, want album/image.jpg with %d bytes", object, len("original"))
+	}
+
+	object, err = storage.Stat("album/missing.jpg")
+	if object != nil || err != nil {
+		t.Errorf("Stat of a missing key = %+v, %v, want nil, nil", object, err)
+	}
+
+	reader, err := storage.Get("/album/image.jpg")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "original" {
+		t.Errorf("Get read %q, %v, want %q", data, err, "original")
+	}
+
+	_, err = storage.Get("album/missing.jpg")
+	if !isS3NotFound(err) {
+		t.Errorf("Get of a missing key = %v, want a not found error", err)
+	}
+
+	objects, err := storage.List("/album/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if strings.Join(keys, ",") != "album/image.jpg,album/image.thumb.jpg" {
+		t.Errorf("List = %v, want album/image.jpg and album/image.thumb.jpg", keys)
+	}
+
+	err = storage.Delete("album/image.jpg")
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	object, err = storage.Stat("album/image.jpg")
+	if object != nil || err != nil {
+		t.Errorf("Stat after Delete = %+v, %v, want nil, nil", object, err)
+	}
+}
+
+func TestS3StorageServeHTTP(t *testing.T) {
+	storage, _ := newTestS3Storage(t)
+
+	err := storage.Put("album/image.thumb.jpg", strings.NewReader("thumb"), 5, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/album/image.thumb.jpg", http.StatusOK, "thumb", "image/jpeg"},
+		{"/album/missing.thumb.jpg", http.StatusNotFound, "", ""},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		storage.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("GET %s = %d, want %d", test.path, recorder.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if recorder.Body.String() != test.body || recorder.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("GET %s = %q as %s, want %q as %s", test.path, recorder.Body.String(), recorder.Header().Get("Content-Type"), test.body, test.contentType)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix makes tokens recognisable when they turn up in logs or
+// secret scanners.
+const apiTokenPrefix = "pft_"
+
+// lastUsedResolution limits how often authenticating with a token writes its
+// last used timestamp.
+const lastUsedResolution = time.Minute
+
+var errInvalidAPIToken = errors.New("Invalid or expired API token")
+var errAPITokenNotFound = errors.New("API token not found")
+var errAPITokenNameRequired = errors.New("Token name is required")
+var errAPITokenExpired = errors.New("Token expiry must be in the future")
+
+type TokenManager struct {
+	AppState   *AppState
+	Repository *Repository
+}
+
+func newTokenManager(a *AppState) *TokenManager {
+	return &TokenManager{
+		AppState:   a,
+		Repository: a.Repository,
+	}
+}
+
+// createToken issues a new token for the user. The token itself is only
+// returned here; the database keeps its hash.
+func (m *TokenManager) createToken(userID string, name string, expires *time.Time) (string, *APITokenRecord, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errAPITokenNameRequired
+	}
+
+	if expires != nil && !expires.After(time.Now()) {
+		return "", nil, errAPITokenExpired
+	}
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	record := &APITokenRecord{
+		ID:        m.AppState.generateID(),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Expires:   expires,
+		Created:   time.Now().UTC(),
+	}
+
+	err = m.Repository.createAPITokenRecord(record)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, record, nil
+}
+
+func (m *TokenManager) getUserTokens(userID string) ([]*APITokenRecord, error) {
+	return m.Repository.getAPITokenRecordsByUserID(userID)
+}
+
+func (m *TokenManager) revokeToken(userID string, tokenID string) error {
+	found, err := m.Repository.deleteAPITokenRecord(userID, tokenID)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errAPITokenNotFound
+	}
+
+	return nil
+}
+
+// authenticateToken returns the active user a bearer token belongs to and
+// records that the token was used.
+func (m *TokenManager) authenticateToken(token string) (*UserRecord, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, errInvalidAPIToken
+	}
+
+	record, err := m.Repository.getAPITokenRecordByHash(hashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if record == nil || record.isExpired(now) {
+		return nil, errInvalidAPIToken
+	}
+
+	user, err := m.Repository.getUserRecord(record.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled {
+		return nil, errInvalidAPIToken
+	}
+
+	if record.LastUsed == nil || now.Sub(*record.LastUsed) >= lastUsedResolution {
+		err = m.Repository.updateAPITokenLastUsed(record.ID, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (t *APITokenRecord) isExpired(now time.Time) bool {
+	return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+func (t *APITokenRecord) IsExpired() bool {
+	return t.isExpired(time.Now())
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed "12345678901234567890" from RFC 6238.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC 6238 appendix B codes have 8 digits. Picfolio uses 6, which are
+// the last 6 digits of each.
+func TestGetTOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := getTOTPCode(rfc6238Secret, getTOTPCounter(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("getTOTPCode at %d: %v", test.unix, err)
+		}
+		if code != test.code {
+			t.Errorf("getTOTPCode at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTOTPCode(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := getTOTPCounter(now)
+
+	codeAt := func(counter int64) string {
+		code, err := getTOTPCode(rfc6238Secret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	counterPtr := func(counter int64) *int64 {
+		return &counter
+	}
+
+	tests := []struct {
+		name        string
+		code        string
+		now         time.Time
+		lastCounter *int64
+		counter     int64
+		ok          bool
+	}{
+		{"current period", codeAt(current), now, nil, current, true},
+		{"previous period", codeAt(current - 1), now, nil, current - 1, true},
+		{"next period", codeAt(current + 1), now, nil, current + 1, true},
+		{"two periods behind", codeAt(current - 2), now, nil, 0, false},
+		{"two periods ahead", codeAt(current + 2), now, nil, 0, false},
+		{"first second of a period", codeAt(current + 1), time.Unix((current+1)*totpPeriod, 0), nil, current + 1, true},
+		{"last second of a period", codeAt(current - 1), time.Unix((current+1)*totpPeriod-1, 0), nil, current - 1, true},
+		{"spaces are ignored", " 081 804 ", now, nil, current, true},
+		{"wrong code", "000000", now, nil, 0, false},
+		{"too short", "81804", now, nil, 0, false},
+		{"too long", "0081804", now, nil, 0, false},
+		{"replayed code", codeAt(current), now, counterPtr(current), 0, false},
+		{"code older than the last one used", codeAt(current - 1), now, counterPtr(current), 0, false},
+		{"code newer than the last one used", codeAt(current + 1), now, counterPtr(current), current + 1, true},
+		{"code after the last one used", codeAt(current), now, counterPtr(current - 1), current, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter, ok := verifyTOTPCode(rfc6238Secret, test.code, test.now, test.lastCounter)
+			if ok != test.ok || counter != test.counter {
+				t.Errorf("verifyTOTPCode(%q) = %d, %t, want %d, %t", test.code, counter, ok, test.counter, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusInfoExtension marks the file holding a resumable upload's details. The
+// data received so far is kept next to it in a file named after the upload.
+const tusInfoExtension = ".info"
+
+// tusFinishedRetention is how long a finished upload is remembered, so a
+// client that missed the answer still finds out which image it became.
+const tusFinishedRetention = 24 * time.Hour
+
+var errTusUploadNotFound = errors.New("Upload not found")
+var errTusUploadLocked = errors.New("The upload is already receiving data")
+var errTusOffsetMismatch = errors.New("Upload-Offset doesn't match the data received so far")
+var errTusLengthExceeded = errors.New("The data is longer than Upload-Length")
+
+// TusUpload is a resumable upload in progress, or one that has recently
+// become an image with ImageID.
+type TusUpload struct {
+	ID       string    `json:"id"`
+	AlbumID  string    `json:"albumId"`
+	UserID   string    `json:"userId"`
+	FileName string    `json:"fileName"`
+	Length   int64     `json:"length"`
+	Created  time.Time `json:"created"`
+	ImageID  string    `json:"imageId,omitempty"`
+	// Offset and Modified come from the data file rather than the info file,
+	// so they can't disagree with what's actually on disk. A finished
+	// upload's data is gone, so they come from the info file instead.
+	Offset   int64     `json:"-"`
+	Modified time.Time `json:"-"`
+}
+
+func (u *TusUpload) isComplete() bool {
+	return u.Offset == u.Length
+}
+
+func (u *TusUpload) isFinished() bool {
+	return u.ImageID != ""
+}
+
+// TusManager keeps resumable uploads under temp/tus until all their data has
+// arrived, then turns them into images. Both files of an upload live there
+// so uploads survive a restart, and the startup temp cleanup and the
+// integrity checker leave the subdirectory alone.
+type TusManager struct {
+	AppState     *AppState
+	ImageManager *ImageManager
+	Config       *UploadsConfig
+
+	lock   sync.Mutex
+	active map[string]bool
+}
+
+func newTusManager(a *AppState) *TusManager {
+	return &TusManager{
+		AppState:     a,
+		ImageManager: a.ImageManager,
+		Config:       &a.Config.Uploads,
+		active:       make(map[string]bool),
+	}
+}
+
+func (m *TusManager) createUpload(albumID string, userID string, fileName string, length int64) (*TusUpload, error) {
+	if !isSupportedFileName(fileName) {
+		m.AppState.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		err := newUnsupportedImageError(fileName)
+		m.AppState.UploadEvents.publishRejected(albumID, err)
+		return nil, err
+	}
+
+	if m.Config.MaxFileSize > 0 && length > int64(m.Config.MaxFileSize) {
+		m.AppState.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+		err := newFileTooLargeError(fileName, m.Config.MaxFileSize)
+		m.AppState.UploadEvents.publishRejected(albumID, err)
+		return nil, err
+	}
+
+	err := os.MkdirAll(m.getDirectoryPath(), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &TusUpload{
+		ID:       m.AppState.generateID(),
+		AlbumID:  albumID,
+		UserID:   userID,
+		FileName: fileName,
+		Length:   length,
+		Created:  time.Now().UTC(),
+	}
+
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(m.getDataFilePath(upload.ID), nil, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(m.getInfoFilePath(upload.ID), info, 0644)
+	if err != nil {
+		os.Remove(m.getDataFilePath(upload.ID))
+		return nil, err
+	}
+
+	upload.Modified = upload.Created
+
+	return upload, nil
+}
+
+func (m *TusManager) getUpload(uploadID string) (*TusUpload, error) {
+	if !isTusUploadID(uploadID) {
+		return nil, errTusUploadNotFound
+	}
+
+	info, err := ioutil.ReadFile(m.getInfoFilePath(uploadID))
+	if os.IsNotExist(err) {
+		return nil, errTusUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &TusUpload{}
+	err = json.Unmarshal(info, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.isFinished() {
+		infoFile, err := os.Stat(m.getInfoFilePath(uploadID))
+		if err != nil {
+			return nil, err
+		}
+
+		upload.Offset = upload.Length
+		upload.Modified = infoFile.ModTime()
+
+		return upload, nil
+	}
+
+	data, err := os.Stat(m.getDataFilePath(uploadID))
+	if os.IsNotExist(err) {
+		return nil, errTusUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload.Offset = data.Size()
+	upload.Modified = data.ModTime()
+
+	return upload, nil
+}
+
+// writeChunk appends data from reader to the upload, which must already
+// have offset bytes. Whatever arrives is kept even when reader fails part
+// way, so the client can resume from there.
+func (m *TusManager) writeChunk(upload *TusUpload, offset int64, reader io.Reader) error {
+	if !m.acquire(upload.ID) {
+		return errTusUploadLocked
+	}
+	defer m.release(upload.ID)
+
+	// Another request may have added data since the upload was read.
+	current, err := m.getUpload(upload.ID)
+	if err != nil {
+		return err
+	}
+	*upload = *current
+
+	if offset != upload.Offset {
+		return errTusOffsetMismatch
+	}
+
+	// The request repeats the one that finished the upload, which has no
+	// data left to add to.
+	if upload.isFinished() {
+		return nil
+	}
+
+	file, err := os.OpenFile(m.getDataFilePath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	// One byte past the length is read so data that's too long is noticed.
+	written, err := io.Copy(file, io.LimitReader(reader, upload.Length-upload.Offset+1))
+	if written > upload.Length-upload.Offset {
+		file.Truncate(upload.Length)
+		written = upload.Length - upload.Offset
+		err = errTusLengthExceeded
+	}
+	upload.Offset += written
+	upload.Modified = time.Now()
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// finishUpload turns a complete upload into an image, returning the image's
+// ID. The upload is kept until its image is created, so the client can
+// finish it again after a server error, unless it isn't a supported image or
+// its album is gone. Afterwards only the image's ID is kept, and finishing
+// the upload again returns it.
+func (m *TusManager) finishUpload(upload *TusUpload) (string, error) {
+	if !m.acquire(upload.ID) {
+		return "", errTusUploadLocked
+	}
+	defer m.release(upload.ID)
+
+	// Another request may have finished the upload since it was read.
+	current, err := m.getUpload(upload.ID)
+	if err != nil {
+		return "", err
+	}
+	*upload = *current
+
+	if upload.isFinished() {
+		return upload.ImageID, nil
+	}
+
+	// createImage removes the file it's given, so it gets a link to the
+	// upload's data rather than the data itself.
+	filePath := filepath.Join(m.AppState.imageDirectoryPath, "temp", getTempFileName(upload.FileName))
+
+	err = os.Link(m.getDataFilePath(upload.ID), filePath)
+	if err != nil {
+		return "", err
+	}
+
+	size, hash, err := hashFile(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		m.AppState.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
+		return "", err
+	}
+
+	uploadProfile, err := newUploadProfileFromUpload(filePath, upload.FileName, size, hash)
+	if err != nil {
+		os.Remove(filePath)
+		if _, ok := err.(*UploadError); ok {
+			m.AppState.Metrics.UploadsTotal.WithLabelValues("rejected").Inc()
+			m.AppState.UploadEvents.publishRejected(upload.AlbumID, err)
+			m.forgetUpload(upload.ID)
+		} else {
+			m.AppState.Metrics.UploadsTotal.WithLabelValues("failed").Inc()
+		}
+		return "", err
+	}
+
+	m.AppState.Metrics.UploadsTotal.WithLabelValues("accepted").Inc()
+	m.AppState.Metrics.UploadBytesTotal.Add(float64(uploadProfile.Size))
+
+	imageID, err := m.ImageManager.createImage(upload.AlbumID, uploadProfile)
+	if err == errAlbumNotFound {
+		m.forgetUpload(upload.ID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	upload.ImageID = imageID
+	err = m.saveFinishedUpload(upload)
+	if err != nil {
+		slog.Warn("Unable to record finished resumable upload", "upload_id", upload.ID, "image_id", imageID, "error", err)
+		m.forgetUpload(upload.ID)
+	}
+
+	return imageID, nil
+}
+
+// saveFinishedUpload records which image the upload became, then deletes
+// its data. The record is written first, so the upload can't look both
+// unfinished and empty.
+func (m *TusManager) saveFinishedUpload(upload *TusUpload) error {
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(m.getInfoFilePath(upload.ID), info, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(m.getDataFilePath(upload.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// forgetUpload removes a finished upload's files. A failure only leaves
+// files for expiry to clean up, so it's logged rather than returned.
+func (m *TusManager) forgetUpload(uploadID string) {
+	err := m.removeUploadFiles(uploadID)
+	if err != nil {
+		slog.Warn("Unable to remove resumable upload", "upload_id", uploadID, "error", err)
+	}
+}
+
+func (m *TusManager) deleteUpload(upload *TusUpload) error {
+	if !m.acquire(upload.ID) {
+		return errTusUploadLocked
+	}
+	defer m.release(upload.ID)
+
+	return m.removeUploadFiles(upload.ID)
+}
+
+// expireUploads deletes uploads that haven't received data for the
+// configured expiration, returning how many files and bytes went with them.
+// Finished uploads are forgotten once tusFinishedRetention has passed.
+func (m *TusManager) expireUploads(now time.Time) (int, int64, error) {
+	files, err := ioutil.ReadDir(m.getDirectoryPath())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var expiredFiles int
+	var expiredBytes int64
+	checked := make(map[string]bool)
+	for _, file := range files {
+		uploadID := strings.TrimSuffix(file.Name(), tusInfoExtension)
+		if file.IsDir() || checked[uploadID] {
+			continue
+		}
+		checked[uploadID] = true
+
+		upload, err := m.getUpload(uploadID)
+		if err == errTusUploadNotFound {
+			// One of the upload's two files never got written.
+			upload = &TusUpload{ID: uploadID, Modified: file.ModTime()}
+		} else if err != nil {
+			slog.Warn("Unable to read resumable upload", "upload_id", uploadID, "error", err)
+			continue
+		}
+
+		expiry, ok := m.getExpiry(upload)
+		if !ok || now.Before(expiry) || !m.acquire(uploadID) {
+			continue
+		}
+
+		err = m.removeUploadFiles(uploadID)
+		m.release(uploadID)
+		if err != nil {
+			slog.Warn("Unable to remove expired upload", "upload_id", uploadID, "error", err)
+			continue
+		}
+
+		if upload.isFinished() {
+			continue
+		}
+
+		slog.Info("Removed expired resumable upload", "upload_id", uploadID, "album_id", upload.AlbumID, "file", upload.FileName, "bytes", upload.Offset)
+		expiredFiles++
+		expiredBytes += upload.Offset
+	}
+
+	return expiredFiles, expiredBytes, nil
+}
+
+// getExpiry returns when the upload will be deleted if no more data arrives.
+func (m *TusManager) getExpiry(upload *TusUpload) (time.Time, bool) {
+	if upload.isFinished() {
+		return upload.Modified.Add(tusFinishedRetention), true
+	}
+
+	if m.Config.ResumableExpiration == 0 {
+		return time.Time{}, false
+	}
+
+	return upload.Modified.Add(m.Config.ResumableExpiration), true
+}
+
+func (m *TusManager) removeUploadFiles(uploadID string) error {
+	err := os.Remove(m.getDataFilePath(uploadID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Remove(m.getInfoFilePath(uploadID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// acquire keeps one request at a time working on an upload.
+func (m *TusManager) acquire(uploadID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.active[uploadID] {
+		return false
+	}
+
+	m.active[uploadID] = true
+	return true
+}
+
+func (m *TusManager) release(uploadID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.active, uploadID)
+}
+
+func (m *TusManager) getDirectoryPath() string {
+	return filepath.Join(m.AppState.imageDirectoryPath, "temp", "tus")
+}
+
+func (m *TusManager) getDataFilePath(uploadID string) string {
+	return filepath.Join(m.getDirectoryPath(), uploadID)
+}
+
+func (m *TusManager) getInfoFilePath(uploadID string) string {
+	return filepath.Join(m.getDirectoryPath(), uploadID+tusInfoExtension)
+}
+
+// isTusUploadID checks an ID from a URL looks like one generateID made
+// before it's used in a path.
+func isTusUploadID(uploadID string) bool {
+	if uploadID == "" {
+		return false
+	}
+
+	for _, c := range uploadID {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
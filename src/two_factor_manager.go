@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer        = "Picfolio"
+	recoveryCodeCount = 10
+)
+
+// recoveryCodeAlphabet leaves out characters that are easy to misread.
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var errInvalidTwoFactorCode = errors.New("Incorrect authentication code")
+var errTwoFactorNotEnabled = errors.New("Two-factor authentication isn't enabled")
+
+type TwoFactorManager struct {
+	AppState   *AppState
+	Repository *Repository
+	// Clock is the time codes are checked against. Tests can fix it.
+	Clock func() time.Time
+}
+
+func newTwoFactorManager(a *AppState) *TwoFactorManager {
+	return &TwoFactorManager{
+		AppState:   a,
+		Repository: a.Repository,
+		Clock:      time.Now,
+	}
+}
+
+func (u *UserRecord) HasTwoFactor() bool {
+	return u.TOTPSecret != nil
+}
+
+func (m *TwoFactorManager) getProvisioningURI(user *UserRecord, secret string) string {
+	return getTOTPProvisioningURI(totpIssuer, user.Username, secret)
+}
+
+// enable turns on two-factor authentication once the user proves their
+// authenticator produces codes for the pending secret. It returns the new
+// recovery codes, which are only shown this once.
+func (m *TwoFactorManager) enable(user *UserRecord, secret string, code string) ([]string, error) {
+	counter, ok := verifyTOTPCode(secret, code, m.Clock(), nil)
+	if !ok {
+		return nil, errInvalidTwoFactorCode
+	}
+
+	err := m.Repository.updateUserTOTP(user.ID, &secret, &counter)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.regenerateRecoveryCodes(user)
+}
+
+// disable turns off two-factor authentication after checking a current code
+// or recovery code.
+func (m *TwoFactorManager) disable(user *UserRecord, code string) error {
+	err := m.verify(user, code)
+	if err != nil {
+		return err
+	}
+
+	return m.reset(user)
+}
+
+// reset removes a user's second factor without a code, for owners helping
+// someone who lost their authenticator and recovery codes.
+func (m *TwoFactorManager) reset(user *UserRecord) error {
+	err := m.Repository.updateUserTOTP(user.ID, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return m.Repository.deleteRecoveryCodes(user.ID)
+}
+
+// verify accepts either a TOTP code or an unused recovery code. Each is only
+// accepted once.
+func (m *TwoFactorManager) verify(user *UserRecord, code string) error {
+	if !user.HasTwoFactor() {
+		return errTwoFactorNotEnabled
+	}
+
+	if counter, ok := verifyTOTPCode(*user.TOTPSecret, code, m.Clock(), user.TOTPLastCounter); ok {
+		updated, err := m.Repository.updateUserTOTPCounter(user.ID, counter)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return errInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	used, err := m.Repository.useRecoveryCode(user.ID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+func (m *TwoFactorManager) regenerateRecoveryCodes(user *UserRecord) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	codeHashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = code
+		codeHashes[i] = hashRecoveryCode(code)
+	}
+
+	err := m.Repository.setRecoveryCodes(user.ID, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (m *TwoFactorManager) getUnusedRecoveryCodeCount(user *UserRecord) (int, error) {
+	return m.Repository.getUnusedRecoveryCodeCount(user.ID)
+}
+
+// generateRecoveryCode returns a code like "k7mq2-x9hd4".
+func generateRecoveryCode() (string, error) {
+	// Bytes at or above limit are skipped so every character is equally likely.
+	limit := 256 - 256%len(recoveryCodeAlphabet)
+	code := make([]byte, 0, 11)
+	random := make([]byte, 1)
+
+	for len(code) < 11 {
+		if len(code) == 5 {
+			code = append(code, '-')
+			continue
+		}
+
+		_, err := rand.Read(random)
+		if err != nil {
+			return "", err
+		}
+
+		if int(random[0]) >= limit {
+			continue
+		}
+
+		code = append(code, recoveryCodeAlphabet[int(random[0])%len(recoveryCodeAlphabet)])
+	}
+
+	return string(code), nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.Replace(strings.ToLower(strings.TrimSpace(code)), "-", "", -1)
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTwoFactorManager(t *testing.T, now *time.Time) (*TwoFactorManager, *UserRecord) {
+	t.Helper()
+
+	repository := newTestRepository(t)
+	manager := &TwoFactorManager{Repository: repository, Clock: func() time.Time { return *now }}
+
+	err := repository.createUserRecord("user", "alice", nil, RoleOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := repository.getUserRecord("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return manager, user
+}
+
+// reloadUser picks up the counter and secret the manager stored.
+func reloadUser(t *testing.T, manager *TwoFactorManager, user *UserRecord) *UserRecord {
+	t.Helper()
+
+	user, err := manager.Repository.getUserRecord(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestTwoFactorVerifyTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	manager, user := newTestTwoFactorManager(t, &now)
+
+	_, err := manager.enable(user, rfc6238Secret, "081804")
+	if err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	user = reloadUser(t, manager, user)
+
+	// The code that turned two-factor on can't be used again to sign in.
+	err = manager.verify(user, "081804")
+	if err != errInvalidTwoFactorCode {
+		t.Fatalf("verify with the enrollment code = %v, want %v", err, errInvalidTwoFactorCode)
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+	code, err := getTOTPCode(rfc6238Secret, getTOTPCounter(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.verify(user, code)
+	if err != nil {
+		t.Fatalf("verify with the next code: %v", err)
+	}
+
+	// A second request that read the user before the first stored its
+	// counter still can't reuse the code.
+	err = manager.verify(user, code)
+	if err != errInvalidTwoFactorCode {
+		t.Fatalf("verify with a stale user = %v, want %v", err, errInvalidTwoFactorCode)
+	}
+
+	err = manager.verify(reloadUser(t, manager, user), code)
+	if err != errInvalidTwoFactorCode {
+		t.Fatalf("verify with a replayed code = %v, want %v", err, errInvalidTwoFactorCode)
+	}
+}
+
+func TestTwoFactorVerifyRecoveryCode(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	manager, user := newTestTwoFactorManager(t, &now)
+
+	codes, err := manager.enable(user, rfc6238Secret, "081804")
+	if err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("enable returned %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	user = reloadUser(t, manager, user)
+
+	err = manager.verify(user, codes[0])
+	if err != nil {
+		t.Fatalf("verify with a recovery code: %v", err)
+	}
+
+	err = manager.verify(user, codes[0])
+	if err != errInvalidTwoFactorCode {
+		t.Fatalf("verify with a used recovery code = %v, want %v", err, errInvalidTwoFactorCode)
+	}
+
+	// Recovery codes can be typed in capitals and without the dash.
+	err = manager.verify(user, " "+strings.ToUpper(strings.Replace(codes[1], "-", "", -1))+" ")
+	if err != nil {
+		t.Fatalf("verify with a reformatted recovery code: %v", err)
+	}
+
+	count, err := manager.getUnusedRecoveryCodeCount(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != recoveryCodeCount-2 {
+		t.Errorf("getUnusedRecoveryCodeCount = %d, want %d", count, recoveryCodeCount-2)
+	}
+
+	// Recovery codes don't depend on the clock.
+	now = now.Add(24 * time.Hour)
+	err = manager.verify(user, codes[2])
+	if err != nil {
+		t.Fatalf("verify with a recovery code a day later: %v", err)
+	}
+
+	err = manager.disable(user, codes[3])
+	if err != nil {
+		t.Fatalf("disable with a recovery code: %v", err)
+	}
+
+	user = reloadUser(t, manager, user)
+	if user.HasTwoFactor() {
+		t.Error("two-factor authentication is still enabled after disable")
+	}
+
+	err = manager.verify(user, codes[4])
+	if err != errTwoFactorNotEnabled {
+		t.Errorf("verify after disable = %v, want %v", err, errTwoFactorNotEnabled)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	uploadEventReceived    = "received"
+	uploadEventDecoded     = "decoded"
+	uploadEventThumbnailed = "thumbnailed"
+	uploadEventFailed      = "failed"
+	uploadEventDone        = "done"
+)
+
+// uploadEventKeepAlive is how often an idle event stream sends a comment,
+// so proxies don't close it.
+const uploadEventKeepAlive = 30 * time.Second
+
+// uploadEventBuffer is how many events a subscriber can fall behind by
+// before it's dropped.
+const uploadEventBuffer = 256
+
+// UploadEvent reports a step in turning an uploaded file into an image.
+// Files rejected before they became an image have no ImageID.
+type UploadEvent struct {
+	Type     string     `json:"type"`
+	AlbumID  string     `json:"albumId"`
+	ImageID  string     `json:"imageId,omitempty"`
+	FileName string     `json:"fileName,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Photo    *GridPhoto `json:"photo,omitempty"`
+}
+
+// GridPhoto is an image as the album page's photo grid and viewer expect it.
+// Status is only set while the image isn't ready, when it's shown as a
+// placeholder.
+type GridPhoto struct {
+	PID        string           `json:"pid"`
+	Src        string           `json:"src"`
+	SrcSet     string           `json:"srcset"`
+	Renditions []*GridRendition `json:"renditions"`
+	MSrc       string           `json:"msrc"`
+	Title      *string          `json:"title"`
+	Height     int              `json:"h"`
+	Width      int              `json:"w"`
+	Metadata   ImageMetadata    `json:"metadata"`
+	Status     string           `json:"status,omitempty"`
+}
+
+type GridRendition struct {
+	Src    string `json:"src"`
+	Width  int    `json:"w"`
+	Height int    `json:"h"`
+}
+
+func newGridPhoto(record *ImageRecord) *GridPhoto {
+	renditions := make([]*GridRendition, len(record.Renditions))
+	for i, rendition := range record.Renditions {
+		renditions[i] = &GridRendition{
+			Src:    rendition.URL(),
+			Width:  rendition.Width,
+			Height: rendition.Height,
+		}
+	}
+
+	photo := &GridPhoto{
+		PID:        record.ID,
+		Src:        record.DisplayURL(),
+		SrcSet:     record.SrcSet(),
+		Renditions: renditions,
+		MSrc:       getImageURL(getThumbnailFilePath(record.Path)),
+		Title:      record.Description,
+		Height:     record.Height,
+		Width:      record.Width,
+		Metadata:   record.Metadata,
+	}
+
+	if record.Status != imageStatusReady {
+		photo.Status = record.Status
+	}
+
+	return photo
+}
+
+// UploadEvents passes upload events to the admin pages watching an album.
+// Events are only kept in memory, so a page only sees what happens while
+// it's connected.
+type UploadEvents struct {
+	lock        sync.Mutex
+	subscribers map[string]map[chan *UploadEvent]bool
+	closed      bool
+}
+
+func newUploadEvents() *UploadEvents {
+	return &UploadEvents{
+		subscribers: make(map[string]map[chan *UploadEvent]bool),
+	}
+}
+
+// subscribe returns a channel of the album's events and a function to stop
+// receiving them. The channel is closed when the subscriber falls too far
+// behind or the events are closed for shutdown.
+func (e *UploadEvents) subscribe(albumID string) (<-chan *UploadEvent, func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	events := make(chan *UploadEvent, uploadEventBuffer)
+	if e.closed {
+		close(events)
+		return events, func() {}
+	}
+
+	if e.subscribers[albumID] == nil {
+		e.subscribers[albumID] = make(map[chan *UploadEvent]bool)
+	}
+	e.subscribers[albumID][events] = true
+
+	return events, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+
+		e.remove(albumID, events)
+	}
+}
+
+// publish sends event to the album's subscribers without waiting for them.
+func (e *UploadEvents) publish(event *UploadEvent) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for events := range e.subscribers[event.AlbumID] {
+		select {
+		case events <- event:
+		default:
+			slog.Warn("Dropping slow upload event subscriber", "album_id", event.AlbumID)
+			e.remove(event.AlbumID, events)
+		}
+	}
+}
+
+// publishRejected reports a file that was turned away, when err is about
+// one file rather than the whole upload.
+func (e *UploadEvents) publishRejected(albumID string, err error) {
+	uploadErr, ok := err.(*UploadError)
+	if !ok || uploadErr.FileName == "" {
+		return
+	}
+
+	e.publish(&UploadEvent{
+		Type:     uploadEventFailed,
+		AlbumID:  albumID,
+		FileName: uploadErr.FileName,
+		Reason:   uploadErr.Message,
+	})
+}
+
+// close ends every subscription, so the streams reading them finish and
+// the server can shut down.
+func (e *UploadEvents) close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for albumID, subscribers := range e.subscribers {
+		for events := range subscribers {
+			e.remove(albumID, events)
+		}
+	}
+	e.closed = true
+}
+
+func (e *UploadEvents) remove(albumID string, events chan *UploadEvent) {
+	if !e.subscribers[albumID][events] {
+		return
+	}
+
+	delete(e.subscribers[albumID], events)
+	if len(e.subscribers[albumID]) == 0 {
+		delete(e.subscribers, albumID)
+	}
+	close(events)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minimumPasswordLength = 8
+
+// Role grants an account a level of access. Each role includes everything the
+// roles ranked below it can do.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleUploader Role = "uploader"
+	RoleEditor   Role = "editor"
+	RoleOwner    Role = "owner"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:   1,
+	RoleUploader: 2,
+	RoleEditor:   3,
+	RoleOwner:    4,
+}
+
+var errInvalidCredentials = errors.New("Incorrect username or password")
+
+type UserManager struct {
+	AppState   *AppState
+	Repository *Repository
+}
+
+func newUserManager(a *AppState) *UserManager {
+	return &UserManager{
+		AppState:   a,
+		Repository: a.Repository,
+	}
+}
+
+func parseRole(value string) (Role, error) {
+	role := Role(strings.ToLower(value))
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("Unknown role %q, expected one of viewer, uploader, editor or owner", value)
+	}
+
+	return role, nil
+}
+
+func (r Role) includes(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// isAlbumScoped reports whether the user only has access to the albums
+// granted to them. Owners always have access to every album.
+func (u *UserRecord) isAlbumScoped() bool {
+	return len(u.AlbumPermissions) > 0 && !u.Role.includes(RoleOwner)
+}
+
+// getAlbumRole is the user's role within an album. Users without album
+// grants have their account role in every album. Users with grants have the
+// role granted in each of those albums and no role in any other, which is
+// empty and includes nothing.
+func (u *UserRecord) getAlbumRole(albumID string) Role {
+	if !u.isAlbumScoped() {
+		return u.Role
+	}
+
+	return u.AlbumPermissions[albumID]
+}
+
+func (u *UserRecord) canViewAlbum(albumID string) bool {
+	return u.getAlbumRole(albumID).includes(RoleViewer)
+}
+
+func (u *UserRecord) CanEdit() bool {
+	return u.Role.includes(RoleEditor)
+}
+
+func (u *UserRecord) IsOwner() bool {
+	return u.Role.includes(RoleOwner)
+}
+
+func (m *UserManager) createUser(username string, password string, role Role) (string, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return "", fmt.Errorf("Username is required")
+	}
+
+	existing, err := m.Repository.getUserRecordByUsername(username)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("User %q already exists", username)
+	}
+
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	userID := m.AppState.generateID()
+	err = m.Repository.createUserRecord(userID, username, &passwordHash, role)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func (m *UserManager) getUser(userID string) (*UserRecord, error) {
+	return m.Repository.getUserRecord(userID)
+}
+
+func (m *UserManager) getUserByUsername(username string) (*UserRecord, error) {
+	user, err := m.Repository.getUserRecordByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("User %q not found", username)
+	}
+
+	return user, nil
+}
+
+func (m *UserManager) getAllUsers() ([]*UserRecord, error) {
+	return m.Repository.getAllUserRecords()
+}
+
+// authenticate returns the active user matching the credentials. Unknown
+// users, disabled users and wrong passwords all fail the same way.
+func (m *UserManager) authenticate(username string, password string) (*UserRecord, error) {
+	user, err := m.Repository.getUserRecordByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || user.Disabled || user.PasswordHash == nil {
+		return nil, errInvalidCredentials
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(*user.PasswordHash), []byte(password))
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return user, nil
+}
+
+func (m *UserManager) resetPassword(username string, password string) error {
+	user, err := m.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = m.Repository.updateUserPassword(user.ID, &passwordHash)
+	if err != nil {
+		return err
+	}
+
+	return m.Repository.deleteSessionRecordsByUserID(user.ID)
+}
+
+func (m *UserManager) setUserRole(username string, role Role) error {
+	user, err := m.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	return m.Repository.updateUserRole(user.ID, role)
+}
+
+func (m *UserManager) setUserDisabled(username string, disabled bool) error {
+	user, err := m.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	err = m.Repository.updateUserDisabled(user.ID, disabled)
+	if err != nil || !disabled {
+		return err
+	}
+
+	return m.Repository.deleteSessionRecordsByUserID(user.ID)
+}
+
+func (m *UserManager) grantAlbumRole(username string, albumID string, role Role) error {
+	user, err := m.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	album, err := m.Repository.getAlbumRecord(albumID)
+	if err != nil {
+		return err
+	}
+	if album == nil {
+		return fmt.Errorf("Album %q not found", albumID)
+	}
+
+	return m.Repository.setAlbumPermission(user.ID, albumID, role)
+}
+
+func (m *UserManager) revokeAlbumRole(username string, albumID string) error {
+	user, err := m.getUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	return m.Repository.deleteAlbumPermission(user.ID, albumID)
+}
+
+// bootstrapOwner creates the first owner account from the legacy ADMIN_KEY
+// credentials so existing installs keep working after upgrading.
+func (m *UserManager) bootstrapOwner(credentials *Credentials) error {
+	count, err := m.Repository.getUserCount()
+	if err != nil {
+		return err
+	}
+
+	if count > 0 || credentials == nil {
+		return nil
+	}
+
+	// Legacy passwords predate the length rule, so they are hashed as-is.
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	hash := string(passwordHash)
+	err = m.Repository.createUserRecord(m.AppState.generateID(), credentials.Username, &hash, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Created owner account from ADMIN_KEY", "username", credentials.Username)
+
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minimumPasswordLength {
+		return "", fmt.Errorf("Passwords must be at least %d characters", minimumPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
@@ -1,3 +1,12 @@
+$.ajaxSetup({
+    beforeSend: function(xhr, settings) {
+        var csrfToken = $('meta[name="csrf-token"]').attr('content');
+        if (csrfToken && !/^(GET|HEAD|OPTIONS)$/i.test(settings.type)) {
+            xhr.setRequestHeader('X-CSRF-Token', csrfToken);
+        }
+    }
+});
+
 $(document).ready(function() {
     if ($('.image-container').length) {
         initPhotoGrid();
@@ -12,6 +21,27 @@ $(document).ready(function() {
         };
     }
 
+    // The admin album page follows uploads live, falling back to reloading
+    // once pending images are processed when it can't.
+    if (typeof pendingPhotos !== 'undefined') {
+        var isLive = watchUploadEvents(albumId);
+        var pendingImages = pendingPhotos.filter(function(photo) {
+            return !isLive || photo.status === 'failed';
+        }).map(function(photo) {
+            return {id: photo.pid, status: photo.status};
+        });
+
+        if (pendingImages.length) {
+            watchPendingImages(albumId, pendingImages);
+        }
+    }
+
+    if ($('.image-editor[data-status!="ready"]').length) {
+        watchPendingImages(album.id, $('.image-editor[data-status!="ready"]').map(function() {
+            return {id: this.getAttribute('data-id'), status: this.getAttribute('data-status')};
+        }).get());
+    }
+
     $('#album-editor-title').blur(function(event) {
         var modifiedValue = event.target.value;
 
@@ -109,15 +139,417 @@ $(document).ready(function() {
     $('.image-editor-rotate-button').click(function(event) {
         var photoId = event.target.closest('.image-editor').getAttribute('data-id');
 
+        var button = $(event.target.closest('.image-editor-rotate-button')).attr('disabled', true);
+
+        // The thumbnail is remade by a background job, so it's only reloaded
+        // once that has finished.
         $.post('/image/' + photoId + '/rotate', function() {
-            var imgElem = event.target.closest('.image-editor').querySelector('.image-editor-thumbnail');
-            var imgSrc = imgElem.getAttribute('src');
-            var d = new Date();
-            $(imgElem).attr('src', imgSrc + '?' + d.getTime())
+            watchImageJobs(album.id, [photoId], function() {
+                var imgElem = event.target.closest('.image-editor').querySelector('.image-editor-thumbnail');
+                var imgSrc = imgElem.getAttribute('src').split('?')[0];
+                var d = new Date();
+                $(imgElem).attr('src', imgSrc + '?' + d.getTime())
+                button.removeAttr('disabled');
+            });
+        }).fail(function() {
+            button.removeAttr('disabled');
+        });
+    });
+
+    $('.upload-form').submit(function(event) {
+        // Uploads always go through tus, which sends the CSRF token as a
+        // header.
+        event.preventDefault();
+
+        var files = $(this).find('input[type="file"]')[0].files;
+        if (files.length === 0) {
+            return;
+        }
+
+        uploadFiles(this, Array.from(files));
+    });
+
+    $('.token-revoke-button').click(function(event) {
+        var tokenId = event.target.closest('.token-row').getAttribute('data-id');
+
+        $.ajax({
+            url: '/tokens/' + tokenId,
+            type: 'DELETE',
+            success: function() {
+                window.location.href = "/tokens";
+            }
+        });
+    });
+
+    $('.session-revoke-button').click(function(event) {
+        var sessionRow = event.target.closest('.session-row');
+
+        $.ajax({
+            url: '/sessions/' + sessionRow.getAttribute('data-id'),
+            type: 'DELETE',
+            success: function() {
+                if (sessionRow.hasAttribute('data-current')) {
+                    window.location.href = "/login";
+                } else {
+                    window.location.href = "/sessions";
+                }
+            }
         });
     });
 });
 
+// Uploads go one file at a time over tus so a dropped connection resumes
+// where it stopped, including after the page is reloaded.
+var tusChunkSize = 8 * 1024 * 1024;
+var tusRetryDelays = [1000, 3000, 5000, 10000, 20000];
+
+var uploadFiles = function(form, files) {
+    var albumId = form.getAttribute('data-album-id');
+    var list = $(form).find('.upload-progress').empty();
+    var rows = files.map(function(file) {
+        return addUploadRow(list, file);
+    });
+
+    $(form).find('input[type="file"], button[type="submit"]').attr('disabled', true);
+
+    var uploaded = 0;
+    var upload = function(index) {
+        if (index >= files.length && uploadEventsConnected) {
+            // New images are added to the grid as they're processed.
+            $(form).find('input[type="file"], button[type="submit"]').removeAttr('disabled');
+            return;
+        }
+
+        if (index >= files.length) {
+            if (uploaded === files.length) {
+                location.reload();
+                return;
+            }
+
+            $(form).find('input[type="file"], button[type="submit"]').removeAttr('disabled');
+            if (uploaded > 0) {
+                $(form).closest('.modal').one('hidden.bs.modal', function() {
+                    location.reload();
+                });
+            }
+            return;
+        }
+
+        var row = rows[index];
+        tusUpload(albumId, files[index], function(offset, size) {
+            setUploadProgress(row, offset, size);
+        }).then(function(imageId) {
+            uploaded++;
+            if (!uploadEventsConnected || !imageId) {
+                setUploadStatus(row, 'Uploaded', 'bg-success');
+                return;
+            }
+
+            uploadRowsByImage[imageId] = row;
+            setUploadStatus(row, 'Processing', 'bg-info');
+            if (imageEvents[imageId]) {
+                showUploadEvent(row, imageEvents[imageId]);
+            }
+        }, function(message) {
+            setUploadStatus(row, message, 'bg-danger');
+        }).then(function() {
+            upload(index + 1);
+        });
+    };
+
+    upload(0);
+};
+
+var addUploadRow = function(list, file) {
+    var row = $('<li class="upload-progress-item">' +
+        '<div class="upload-progress-name">' + escapeHtml(file.name) + '</div>' +
+        '<div class="progress"><div class="progress-bar" role="progressbar" style="width:0%"></div></div>' +
+        '<small class="upload-progress-status text-muted">Waiting</small>' +
+        '</li>');
+    list.append(row);
+    return row;
+};
+
+var setUploadProgress = function(row, offset, size) {
+    var percent = size > 0 ? Math.floor(offset / size * 100) : 100;
+    row.find('.progress-bar').css('width', percent + '%');
+    row.find('.upload-progress-status').text(percent + '%');
+};
+
+var setUploadStatus = function(row, message, barClass) {
+    row.find('.progress-bar').css('width', '100%').removeClass('bg-info bg-success bg-danger').addClass(barClass);
+    row.find('.upload-progress-status').text(message);
+};
+
+// tusUpload sends one file, resolving with the image's ID once the server
+// has made it an image and rejecting with a message when it can't be
+// uploaded.
+var tusUpload = function(albumId, file, onProgress) {
+    var storageKey = ['tus', albumId, file.name, file.size, file.lastModified].join(':');
+    var uploadUrl = localStorage.getItem(storageKey);
+    var attempt = 0;
+
+    var fail = function(xhr) {
+        localStorage.removeItem(storageKey);
+        return Promise.reject(xhr.responseText || 'Upload failed');
+    };
+
+    var create = function() {
+        return tusRequest('POST', '/tus/' + albumId, {
+            'Upload-Length': file.size,
+            'Upload-Metadata': 'filename ' + btoa(unescape(encodeURIComponent(file.name)))
+        }).then(function(xhr) {
+            if (xhr.status !== 201) {
+                return fail(xhr);
+            }
+
+            uploadUrl = xhr.getResponseHeader('Location');
+            localStorage.setItem(storageKey, uploadUrl);
+            return send(0);
+        });
+    };
+
+    var resume = function() {
+        return tusRequest('HEAD', uploadUrl, {}).then(function(xhr) {
+            if (xhr.status === 200 && xhr.getResponseHeader('Picfolio-Image-ID')) {
+                localStorage.removeItem(storageKey);
+                return xhr.getResponseHeader('Picfolio-Image-ID');
+            }
+            if (xhr.status === 200) {
+                return send(parseInt(xhr.getResponseHeader('Upload-Offset'), 10));
+            }
+            if (xhr.status === 404 || xhr.status === 410) {
+                localStorage.removeItem(storageKey);
+                return create();
+            }
+            return retry(xhr);
+        });
+    };
+
+    var send = function(offset) {
+        onProgress(offset, file.size);
+
+        var chunk = file.slice(offset, offset + tusChunkSize);
+        return tusRequest('PATCH', uploadUrl, {
+            'Upload-Offset': offset,
+            'Content-Type': 'application/offset+octet-stream'
+        }, chunk, function(loaded) {
+            onProgress(offset + loaded, file.size);
+        }).then(function(xhr) {
+            if (xhr.status !== 204) {
+                return retry(xhr);
+            }
+
+            attempt = 0;
+            var newOffset = parseInt(xhr.getResponseHeader('Upload-Offset'), 10);
+            if (newOffset < file.size) {
+                return send(newOffset);
+            }
+
+            localStorage.removeItem(storageKey);
+            return xhr.getResponseHeader('Picfolio-Image-ID');
+        });
+    };
+
+    // Dropped connections, conflicts and server errors are retried from
+    // whatever the server says it has. Anything else won't get better.
+    var retry = function(xhr) {
+        var retriable = xhr.status === 0 || xhr.status === 409 || xhr.status === 423 || xhr.status >= 500;
+        if (!retriable || attempt >= tusRetryDelays.length) {
+            return fail(xhr);
+        }
+
+        var delay = tusRetryDelays[attempt++];
+        return new Promise(function(resolve) {
+            setTimeout(resolve, delay);
+        }).then(resume);
+    };
+
+    return uploadUrl ? resume() : create();
+};
+
+var tusRequest = function(method, url, headers, body, onProgress) {
+    return new Promise(function(resolve) {
+        var xhr = new XMLHttpRequest();
+        xhr.open(method, url);
+        xhr.setRequestHeader('Tus-Resumable', '1.0.0');
+
+        var csrfToken = $('meta[name="csrf-token"]').attr('content');
+        if (csrfToken && method !== 'HEAD') {
+            xhr.setRequestHeader('X-CSRF-Token', csrfToken);
+        }
+
+        Object.keys(headers).forEach(function(name) {
+            xhr.setRequestHeader(name, headers[name]);
+        });
+
+        if (onProgress) {
+            xhr.upload.onprogress = function(event) {
+                onProgress(event.loaded);
+            };
+        }
+
+        xhr.onload = function() {
+            resolve(xhr);
+        };
+        xhr.onerror = function() {
+            resolve(xhr);
+        };
+
+        xhr.send(body || null);
+    });
+};
+
+// Upload events stream each file's progress from upload to finished image
+// while the album page is open. They're ranked so one that arrives late
+// doesn't undo a later step.
+var uploadEventTypes = ['received', 'decoded', 'thumbnailed', 'failed', 'done'];
+var uploadEventLabels = {received: 'Processing', decoded: 'Decoded', thumbnailed: 'Thumbnailed', done: 'Done'};
+var uploadEventsConnected = false;
+var imageEvents = {};
+var uploadRowsByImage = {};
+
+var watchUploadEvents = function(albumId) {
+    if (typeof EventSource === 'undefined') {
+        return false;
+    }
+
+    var source = new EventSource('/album/' + albumId + '/events');
+    uploadEventTypes.forEach(function(type) {
+        source.addEventListener(type, function(message) {
+            handleUploadEvent(JSON.parse(message.data));
+        });
+    });
+
+    uploadEventsConnected = true;
+    return true;
+};
+
+var handleUploadEvent = function(event) {
+    // Files turned away before becoming images are reported by the upload
+    // that sent them.
+    if (!event.imageId) {
+        return;
+    }
+
+    var previous = imageEvents[event.imageId];
+    if (previous && uploadEventTypes.indexOf(previous.type) >= uploadEventTypes.indexOf(event.type)) {
+        return;
+    }
+    imageEvents[event.imageId] = event;
+
+    var row = uploadRowsByImage[event.imageId];
+    if (row) {
+        showUploadEvent(row, event);
+    }
+
+    updateGridPhoto(event);
+};
+
+var showUploadEvent = function(row, event) {
+    if (event.type === 'failed') {
+        setUploadStatus(row, event.reason || 'Processing failed', 'bg-danger');
+    } else if (event.type === 'done') {
+        setUploadStatus(row, uploadEventLabels[event.type], 'bg-success');
+    } else {
+        setUploadStatus(row, uploadEventLabels[event.type], 'bg-info');
+    }
+};
+
+// updateGridPhoto shows a received image as a placeholder, then swaps in
+// the finished photo or marks it as failed.
+var updateGridPhoto = function(event) {
+    var findPhoto = function(list) {
+        return list.findIndex(function(photo) {
+            return photo.pid === event.imageId;
+        });
+    };
+
+    var pendingIndex = findPhoto(pendingPhotos);
+    var isShown = findPhoto(photos) !== -1;
+
+    if (event.type === 'received' && pendingIndex === -1 && !isShown) {
+        pendingPhotos.push(event.photo);
+    } else if (event.type === 'failed' && pendingIndex !== -1) {
+        pendingPhotos[pendingIndex].status = 'failed';
+        pendingPhotos[pendingIndex].error = event.reason;
+    } else if (event.type === 'done' && !isShown) {
+        if (pendingIndex !== -1) {
+            pendingPhotos.splice(pendingIndex, 1);
+        }
+        photos.push(event.photo);
+    } else {
+        return;
+    }
+
+    if (!$('.image-container').length) {
+        $('.photo-grid').empty().append('<div class="image-container"></div>');
+        window.onresize = function(e){
+            initPhotoGrid();
+        };
+    }
+    initPhotoGrid();
+};
+
+// Thumbnails and renditions are made by background jobs, so pages showing
+// images that are still being processed poll for the jobs to finish.
+var jobPollInterval = 2000;
+
+// watchImageJobs calls done with the album's jobs once none of the images'
+// jobs are waiting or running.
+var watchImageJobs = function(albumId, imageIds, done) {
+    var poll = function() {
+        $.getJSON('/album/' + albumId + '/jobs', function(jobs) {
+            var pending = jobs.some(function(job) {
+                return imageIds.indexOf(job.imageId) !== -1 && (job.status === 'queued' || job.status === 'running');
+            });
+
+            if (pending) {
+                setTimeout(poll, jobPollInterval);
+                return;
+            }
+
+            done(jobs);
+        }).fail(function() {
+            setTimeout(poll, jobPollInterval * 5);
+        });
+    };
+
+    poll();
+};
+
+// watchPendingImages reloads the page once images that were processing are
+// ready, and explains why failed images couldn't be processed.
+var watchPendingImages = function(albumId, images) {
+    var imageIds = images.map(function(image) {
+        return image.id;
+    });
+    var isProcessing = images.some(function(image) {
+        return image.status === 'processing';
+    });
+
+    watchImageJobs(albumId, imageIds, function(jobs) {
+        if (isProcessing) {
+            location.reload();
+            return;
+        }
+
+        jobs.forEach(function(job) {
+            if (job.status === 'failed' && job.error) {
+                var photo = typeof pendingPhotos !== 'undefined' && pendingPhotos.find(function(photo) {
+                    return photo.pid === job.imageId;
+                });
+                if (photo) {
+                    photo.error = job.error;
+                }
+
+                $('.photo-pending[data-pid="' + job.imageId + '"], .image-editor[data-id="' + job.imageId + '"] .image-editor-pending')
+                    .attr('title', 'Processing failed: ' + job.error);
+            }
+        });
+    });
+};
+
 var isEmpty = function (str) {
     return (!str || 0 === str.length);
 }
@@ -133,6 +565,10 @@ var initPhotoGrid = function() {
         gridItems.push(...photos);
     }
 
+    if (typeof pendingPhotos !== 'undefined') {
+        gridItems.push(...pendingPhotos);
+    }
+
     $('.image-container').empty().justifiedImages({
         images : gridItems || [],
         rowHeight: 250,
@@ -172,8 +608,21 @@ var initPhotoGrid = function() {
                     '</div>';
             }
 
+            if (photo.status) {
+                return '<div class="photo-container photo-pending" style="height:' + photo.displayHeight + 'px;margin-right:' + photo.marginRight + 'px;" data-pid="' + photo.pid + '">' +
+                    '<div class="image-thumb" style="width:' + photo.displayWidth + 'px;height:' + photo.displayHeight + 'px;" >' +
+                    '<div class="photo-pending-content">' + (photo.status === 'failed' ? 'Processing failed' : 'Processing…') + '</div>' +
+                    '</div>' +
+                    '</div>';
+            }
+
+            var srcset = '';
+            if (!isEmpty(photo.srcset)) {
+                srcset = ' srcset="' + photo.srcset + '" sizes="' + Math.ceil(photo.displayWidth) + 'px"';
+            }
+
             return '<div class="photo-container swipeclick" style="height:' + photo.displayHeight + 'px;margin-right:' + photo.marginRight + 'px;" data-pid="' + photo.pid + '" >' +
-                '<img class="image-thumb" src="' + photo.src + '" style="width:' + photo.displayWidth + 'px;height:' + photo.displayHeight + 'px;" >' +
+                '<img class="image-thumb" src="' + photo.src + '"' + srcset + ' style="width:' + photo.displayWidth + 'px;height:' + photo.displayHeight + 'px;" >' +
                 '</div>';
         }
     });
@@ -182,6 +631,14 @@ var initPhotoGrid = function() {
         var photoId = event.target.parentNode.getAttribute('data-pid');
         openPhotoSwipe(photoId);
     });
+
+    if (typeof pendingPhotos !== 'undefined') {
+        pendingPhotos.forEach(function(photo) {
+            if (photo.error) {
+                $('.photo-pending[data-pid="' + photo.pid + '"]').attr('title', 'Processing failed: ' + photo.error);
+            }
+        });
+    }
 };
 
 var openPhotoSwipe = function (photoId, disableAnimation) {
@@ -194,6 +651,7 @@ var openPhotoSwipe = function (photoId, disableAnimation) {
     var options = {
         index: initPhotoIndex,
         galleryPIDs: true,
+        addCaptionHTMLFn: addPhotoCaption,
         getThumbBoundsFn: function(index) {
             var thumbnail = document.querySelector('.photo-container[data-pid="' + photos[index].pid + '"]');
 
@@ -209,9 +667,120 @@ var openPhotoSwipe = function (photoId, disableAnimation) {
     }
 
     var gallery = new PhotoSwipe(pswpElement, PhotoSwipeUI_Default, photos, options);
+
+    var viewportWidth = 0;
+    var viewportHeight = 0;
+    var isFirstResize = true;
+
+    // Swap in the smallest rendition that still fills the viewport.
+    gallery.listen('beforeResize', function() {
+        var pixelRatio = window.devicePixelRatio || 1;
+        var width = gallery.viewportSize.x * pixelRatio;
+        var height = gallery.viewportSize.y * pixelRatio;
+
+        var hasGrown = width > viewportWidth || height > viewportHeight;
+        viewportWidth = width;
+        viewportHeight = height;
+
+        if (hasGrown && !isFirstResize) {
+            gallery.invalidateCurrItems();
+        }
+        isFirstResize = false;
+    });
+
+    gallery.listen('gettingData', function(index, item) {
+        var rendition = pickRendition(item.renditions, viewportWidth, viewportHeight);
+        if (rendition) {
+            item.src = rendition.src;
+            item.w = rendition.w;
+            item.h = rendition.h;
+        }
+    });
+
     gallery.init();
 };
 
+var pickRendition = function(renditions, width, height) {
+    if (!renditions || renditions.length === 0) {
+        return null;
+    }
+
+    for (var i = 0; i < renditions.length; i++) {
+        if (renditions[i].w >= width || renditions[i].h >= height) {
+            return renditions[i];
+        }
+    }
+
+    return renditions[renditions.length - 1];
+};
+
+var addPhotoCaption = function(item, captionEl) {
+    var captionParts = [];
+
+    if (!isEmpty(item.title)) {
+        captionParts.push('<div class="photo-caption-title">' + escapeHtml(item.title) + '</div>');
+    }
+
+    var details = getPhotoDetails(item.metadata);
+    if (details.length > 0) {
+        captionParts.push('<div class="photo-caption-details">' + escapeHtml(details.join(' \u00b7 ')) + '</div>');
+    }
+
+    if (captionParts.length === 0) {
+        captionEl.children[0].innerHTML = '';
+        return false;
+    }
+
+    captionEl.children[0].innerHTML = captionParts.join('');
+    return true;
+};
+
+var getPhotoDetails = function(metadata) {
+    var details = [];
+
+    if (!metadata) {
+        return details;
+    }
+
+    if (metadata.captured) {
+        details.push(new Date(metadata.captured).toLocaleString());
+    }
+
+    var camera = [metadata.cameraMake, metadata.cameraModel].filter(function(v) { return !isEmpty(v); });
+    if (camera.length > 0) {
+        // Most makers repeat the brand in the model name.
+        if (camera.length === 2 && camera[1].toLowerCase().indexOf(camera[0].toLowerCase()) === 0) {
+            camera.shift();
+        }
+        details.push(camera.join(' '));
+    }
+
+    if (metadata.lensModel) {
+        details.push(metadata.lensModel);
+    }
+    if (metadata.focalLength) {
+        details.push(Math.round(metadata.focalLength) + 'mm');
+    }
+    if (metadata.fNumber) {
+        details.push('f/' + metadata.fNumber.toFixed(1));
+    }
+    if (metadata.exposureTime) {
+        details.push(metadata.exposureTime + 's');
+    }
+    if (metadata.iso) {
+        details.push('ISO ' + metadata.iso);
+    }
+    if (metadata.creator) {
+        details.push('\u00a9 ' + metadata.creator);
+    }
+
+    return details;
+};
+
+var escapeHtml = function(str) {
+    return $('<div>').text(str).html();
+};
+
 var photoswipeParseHash = function() {
     var hash = window.location.hash.substring(1),
     params = {};